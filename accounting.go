@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GPUAccountingStats holds the lifetime stats NVML keeps per process while
+// accounting mode is enabled, including for processes that have exited.
+type GPUAccountingStats struct {
+	PID uint
+	// MaxMemoryUsage is the peak memory used by the process in bytes.
+	MaxMemoryUsage float64
+	// GPUUtilization and MemoryUtilization are averaged over the lifetime
+	// of the process, in percent.
+	GPUUtilization    float64
+	MemoryUtilization float64
+	// StartTime is in seconds since the epoch.
+	StartTime float64
+	// RunTime is in seconds; it keeps growing while the process runs.
+	RunTime   float64
+	IsRunning bool
+}
+
+// defaultAccountingLimit is the default number of processes exported per
+// device by the accounting metrics. NVML keeps up to 4000 records per device
+// by default, each of which becomes a set of series labeled by pid.
+const defaultAccountingLimit = 100
+
+// accountingKey identifies a process in the accounting buffer. PIDs are
+// recycled, so the start time tells apart processes that had the same PID.
+type accountingKey struct {
+	pid       uint
+	startTime float64
+}
+
+// SetAccountingLimit sets the maximum number of processes exported per device
+// by the accounting metrics, keeping the most recently started ones. 0
+// exports every process NVML keeps a record of. It must be called before the
+// collector is registered.
+func (c *Collector) SetAccountingLimit(n int) {
+	c.Lock()
+	defer c.Unlock()
+	c.accountingLimit = n
+}
+
+// collectAccounting exports the accounting stats of every process NVML has a
+// record of on dev, up to the accounting limit. Processes are attributed
+// through pidInfo while they run; their attribution is remembered so that it
+// survives them exiting, for as long as NVML keeps their record.
+func (c *Collector) collectAccounting(ch chan<- prometheus.Metric, dev NVMLDevice, uuid, minor string, pidInfo map[int]pidMeta) {
+	stats, err := dev.GetAccountingStats()
+	if errors.Is(err, errNotSupported) {
+		delete(c.accountedPIDs, uuid)
+		return
+	}
+	if err != nil {
+		log.Printf("GetAccountingStats() error for device %s: %v", uuid, err)
+		return
+	}
+
+	// Newest first, so that the limit keeps the most recently started
+	// processes and a recycled PID is only exported for its latest process.
+	stats = slices.Clone(stats)
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].StartTime > stats[j].StartTime })
+
+	known := c.accountedPIDs[uuid]
+	accounted := make(map[accountingKey]pidMeta, len(stats))
+	exported := make(map[uint]bool, len(stats))
+	for _, s := range stats {
+		if c.accountingLimit > 0 && len(exported) == c.accountingLimit {
+			break
+		}
+		if exported[s.PID] {
+			continue
+		}
+		exported[s.PID] = true
+		key := accountingKey{pid: s.PID, startTime: s.StartTime}
+		info, ok := known[key]
+		if s.IsRunning {
+			// The PID of a running process can't have been recycled yet.
+			if running, isListed := pidInfo[int(s.PID)]; isListed {
+				info, ok = running, true
+			} else if !ok {
+				info, ok = c.resolvePID(s.PID), true
+			}
+		}
+		if !ok {
+			// The process exited before it could be attributed, and its
+			// PID may already belong to another process.
+			info = pidMeta{container: orphanContainer, namespace: orphanNamespace, pod: orphanPod}
+		}
+		accounted[key] = info
+
+		alv := withLabels(info.labelValues(minor), strconv.FormatUint(uint64(s.PID), 10))
+		c.acctMaxMemory.WithLabelValues(alv...).Set(s.MaxMemoryUsage)
+		c.acctGPUUtil.WithLabelValues(alv...).Set(s.GPUUtilization)
+		c.acctMemUtil.WithLabelValues(alv...).Set(s.MemoryUtilization)
+		c.acctStartTime.WithLabelValues(alv...).Set(s.StartTime)
+		c.acctRunning.WithLabelValues(alv...).Set(boolToFloat(s.IsRunning))
+		ch <- prometheus.MustNewConstMetric(c.acctRunTime, prometheus.CounterValue, s.RunTime, alv...)
+	}
+	// Forget processes whose record NVML has dropped from its buffer.
+	c.accountedPIDs[uuid] = accounted
+}
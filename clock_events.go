@@ -0,0 +1,60 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// NVML clock throttle (clock event) reason bits, as defined by
+// nvmlClocksThrottleReason* in nvml.h.
+const (
+	clockEventGPUIdle                   uint64 = 0x1
+	clockEventApplicationsClocksSetting uint64 = 0x2
+	clockEventSwPowerCap                uint64 = 0x4
+	clockEventHwSlowdown                uint64 = 0x8
+	clockEventSyncBoost                 uint64 = 0x10
+	clockEventSwThermalSlowdown         uint64 = 0x20
+	clockEventHwThermalSlowdown         uint64 = 0x40
+	clockEventHwPowerBrakeSlowdown      uint64 = 0x80
+	clockEventDisplayClockSetting       uint64 = 0x100
+)
+
+// clockEventReasons maps every known reason bit to its label value, in the
+// order the reasons are exported.
+var clockEventReasons = []struct {
+	mask uint64
+	name string
+}{
+	{clockEventGPUIdle, "gpu_idle"},
+	{clockEventApplicationsClocksSetting, "applications_clocks_setting"},
+	{clockEventSwPowerCap, "sw_power_cap"},
+	{clockEventHwSlowdown, "hw_slowdown"},
+	{clockEventSyncBoost, "sync_boost"},
+	{clockEventSwThermalSlowdown, "sw_thermal_slowdown"},
+	{clockEventHwThermalSlowdown, "hw_thermal_slowdown"},
+	{clockEventHwPowerBrakeSlowdown, "hw_power_brake_slowdown"},
+	{clockEventDisplayClockSetting, "display_clock_setting"},
+}
+
+// GPUClockEventReasons holds the reasons the clocks of a device are currently
+// held down, and optionally the cumulative time spent in each of them.
+type GPUClockEventReasons struct {
+	// Active is a bitmask of clockEvent* values.
+	Active uint64
+	// Durations maps a single clockEvent* bit to the total time in seconds
+	// the device spent in that state. It is nil if the driver doesn't
+	// report durations.
+	Durations map[uint64]float64
+}
+
+// collectClockEventReasons exports one 0/1 gauge per known reason and a
+// counter for every reason the driver reports a duration for.
+func (c *Collector) collectClockEventReasons(ch chan<- prometheus.Metric, lv []string, reasons *GPUClockEventReasons) {
+	if reasons == nil {
+		return
+	}
+	for _, r := range clockEventReasons {
+		c.throttleReason.WithLabelValues(withLabels(lv, r.name)...).Set(boolToFloat(reasons.Active&r.mask != 0))
+		if d, ok := reasons.Durations[r.mask]; ok {
+			ch <- prometheus.MustNewConstMetric(c.throttleDuration, prometheus.CounterValue, d,
+				withLabels(lv, r.name)...)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -14,18 +17,64 @@ const (
 	orphanContainer = "unknown"
 	orphanNamespace = "unknown"
 	orphanPod       = "unknown"
+
+	processTypeCompute  = "compute"
+	processTypeGraphics = "graphics"
+	processTypeMPS      = "mps"
+
+	eccSingleBit = "single_bit"
+	eccDoubleBit = "double_bit"
+
+	eccVolatile  = "volatile"
+	eccAggregate = "aggregate"
+
+	eccLocationDeviceMemory = "device_memory"
+	eccLocationL1Cache      = "l1_cache"
+	eccLocationL2Cache      = "l2_cache"
+	eccLocationRegisterFile = "register_file"
+
+	clockDomainGraphics = "graphics"
+	clockDomainSM       = "sm"
+	clockDomainMemory   = "memory"
+	clockDomainVideo    = "video"
+
+	clockCurrent     = "current"
+	clockApplication = "application"
+	clockMax         = "max"
 )
 
 var (
 	labels  = []string{"minor_number", "uuid", "name"}
-	plabels = []string{"minor_number", "pod_name", "container", "namespace"}
+	plabels = []string{"minor_number", "pod_name", "container", "namespace", "type", "gpu_instance_id", "compute_instance_id"}
+
+	miglabels  = withLabels(labels, "gpu_instance_id", "compute_instance_id", "mig_profile")
+	vgpulabels = withLabels(labels, "vgpu_id", "vgpu_type", "vm_id")
+	// acctlabels add the PID to the process labels, as accounting stats
+	// outlive the process and a container may run several processes.
+	acctlabels = withLabels(plabels, "pid")
 )
 
+// errNotSupported is returned by NVMLDevice implementations for data that the
+// device, driver or NVML bindings can't provide. Collect skips it quietly.
+var errNotSupported = errors.New("not supported")
+
 // --- Interfaces for testability ---
 
 type NVMLClient interface {
 	GetDeviceCount() (uint, error)
+	// GetDeviceUUID returns the UUID of the device at idx without reading
+	// the rest of its attributes.
+	GetDeviceUUID(idx uint) (string, error)
 	NewDevice(idx uint) (NVMLDevice, error)
+	GetDriverInfo() (*GPUDriverInfo, error)
+}
+
+// GPUDriverInfo holds the versions of the driver stack. Versions the driver
+// doesn't report are empty.
+type GPUDriverInfo struct {
+	DriverVersion     string
+	CUDADriverVersion string
+	NVMLVersion       string
 }
 
 type NVMLDevice interface {
@@ -34,25 +83,117 @@ type NVMLDevice interface {
 	GetModel() string
 	GetTotalMemory() float64
 	Status() (*GPUDeviceStatus, error)
+	GetComputeRunningProcesses() ([]uint, []uint64, error)
+	GetMPSComputeRunningProcesses() ([]uint, []uint64, error)
 	GetGraphicsRunningProcesses() ([]uint, []uint64, error)
-	GetProcessUtilization() ([]GPUProcessUtilization, error)
+	// GetProcessUtilization returns the utilization samples taken after
+	// lastSeen, a timestamp in microseconds; 0 returns all buffered samples.
+	GetProcessUtilization(lastSeen uint64) ([]GPUProcessUtilization, error)
+	GetNVLinks() ([]GPUNVLink, error)
+	GetRetiredPages() (*GPURetiredPages, error)
+	GetRemappedRows() (*GPURemappedRows, error)
+	GetMIGDevices() ([]GPUMIGDevice, error)
+	GetDeviceMode() (*GPUDeviceMode, error)
+	GetDeviceInfo() (*GPUDeviceInfo, error)
+	// GetTopology reports how the device is connected to peer, another
+	// device of the same client.
+	GetTopology(peer NVMLDevice) (*GPUTopologyLink, error)
+	VGPUHost
+	// GetAccountingStats returns the stats of every process in the
+	// accounting buffer, or errNotSupported if accounting mode is off.
+	GetAccountingStats() ([]GPUAccountingStats, error)
+	// GetFieldValues fetches the given NVML fields in one call.
+	GetFieldValues(ids []uint32) ([]GPUFieldValue, error)
+	GetEncoderSessions() (*GPUSessions, error)
+	GetFBCSessions() (*GPUSessions, error)
 }
 
 type GPUDeviceStatus struct {
-	UsedMemory  float64
-	DutyCycle   float64
-	PowerUsage  float64
-	Temperature float64
-	EncUtil     float64
-	DecUtil     float64
+	UsedMemory float64
+	// FreeMemory and ReservedMemory are nil if the device doesn't report
+	// them. Reserved memory is only split out of UsedMemory by the v2
+	// memory info API.
+	FreeMemory     *float64
+	ReservedMemory *float64
+	BAR1           *GPUBAR1Memory
+	DutyCycle      float64
+	PowerUsage     float64
+	Temperature    float64
+	EncUtil        float64
+	DecUtil        float64
+	ECCErrors      []GPUECCErrorCount
+	ECCMode        *GPUECCMode
+	Clocks         []GPUClock
+	// ClockEventReasons is nil if the device doesn't report throttle reasons.
+	ClockEventReasons *GPUClockEventReasons
+	// PCIe is nil if the device doesn't report any PCIe information.
+	PCIe *GPUPCIeStatus
+	// EnergyJoules is the total energy consumed since the driver was
+	// loaded, or nil if the driver doesn't report it.
+	EnergyJoules *float64
+	PowerLimits  *GPUPowerLimits
+	// PerformanceState is the P-state from 0 (max performance) to 15, or
+	// nil if unknown.
+	PerformanceState *float64
+	// MemoryTemperature is the HBM temperature in celsius, or nil if the
+	// device doesn't report it.
+	MemoryTemperature     *float64
+	TemperatureThresholds *GPUTemperatureThresholds
+	// Fans is empty for passively cooled devices.
+	Fans []GPUFan
+}
+
+// GPUPCIeStatus holds PCIe throughput and link information. Each field is
+// nil when the device or driver doesn't report it.
+type GPUPCIeStatus struct {
+	TxBytesPerSecond  *float64
+	RxBytesPerSecond  *float64
+	LinkGeneration    *float64
+	MaxLinkGeneration *float64
+	LinkWidth         *float64
+	MaxLinkWidth      *float64
+	ReplayCounter     *float64
+}
+
+// GPUBAR1Memory is the BAR1 memory usage of a device in bytes.
+type GPUBAR1Memory struct {
+	Total float64
+	Used  float64
+	Free  float64
+}
+
+// GPUECCErrorCount is a single NVML ECC error counter, identified by
+// error type (single/double bit), counter type (volatile/aggregate) and
+// memory location.
+type GPUECCErrorCount struct {
+	ErrorType   string
+	CounterType string
+	Location    string
+	Count       float64
+}
+
+// GPUClock is the frequency of one clock domain (graphics, sm, memory, video)
+// for one clock type (current, application target or max).
+type GPUClock struct {
+	Domain string
+	Type   string
+	MHz    float64
+}
+
+// GPUECCMode holds the current ECC mode and the mode that will be applied
+// after the next reboot.
+type GPUECCMode struct {
+	Current bool
+	Pending bool
 }
 
 type GPUProcessUtilization struct {
-	PID     uint
-	DecUtil uint
-	EncUtil uint
-	MemUtil uint
-	SmUtil  uint
+	PID       uint
+	DecUtil   uint
+	EncUtil   uint
+	MemUtil   uint
+	SmUtil    uint
+	TimeStamp uint64
 }
 
 type ProcessFinder interface {
@@ -69,9 +210,16 @@ type Collector struct {
 	sync.Mutex
 	nvmlClient  NVMLClient
 	procFinder  ProcessFinder
+	now         func() time.Time
 	numDevices  prometheus.Gauge
+	info        *prometheus.GaugeVec
 	usedMemory  *prometheus.GaugeVec
 	totalMemory *prometheus.GaugeVec
+	freeMemory  *prometheus.GaugeVec
+	resMemory   *prometheus.GaugeVec
+	bar1Total   *prometheus.GaugeVec
+	bar1Used    *prometheus.GaugeVec
+	bar1Free    *prometheus.GaugeVec
 	dutyCycle   *prometheus.GaugeVec
 	powerUsage  *prometheus.GaugeVec
 	temperature *prometheus.GaugeVec
@@ -82,8 +230,135 @@ type Collector struct {
 	pEncUtil    *prometheus.GaugeVec
 	pMemUtil    *prometheus.GaugeVec
 	pSmUtil     *prometheus.GaugeVec
+	pDecUtilMax *prometheus.GaugeVec
+	pEncUtilMax *prometheus.GaugeVec
+	pMemUtilMax *prometheus.GaugeVec
+	pSmUtilMax  *prometheus.GaugeVec
+	// lastSeen holds the timestamp of the newest process utilization
+	// sample consumed per device, keyed by UUID.
+	lastSeen map[string]uint64
+
+	encoderSessions sessionGauges
+	fbcSessions     sessionGauges
+
+	acctMaxMemory *prometheus.GaugeVec
+	acctGPUUtil   *prometheus.GaugeVec
+	acctMemUtil   *prometheus.GaugeVec
+	acctStartTime *prometheus.GaugeVec
+	acctRunning   *prometheus.GaugeVec
+	acctRunTime   *prometheus.Desc
+	// accountedPIDs holds the attribution of the processes in the
+	// accounting buffer per device, keyed by UUID and process.
+	accountedPIDs map[string]map[accountingKey]pidMeta
+	// accountingLimit is the maximum number of processes exported per
+	// device by the accounting metrics, or 0 for no limit.
+	accountingLimit int
+
+	eccMode   *prometheus.GaugeVec
+	eccErrors *prometheus.Desc
+	clock     *prometheus.GaugeVec
+
+	throttleReason   *prometheus.GaugeVec
+	throttleDuration *prometheus.Desc
+
+	pcieThroughput *prometheus.GaugeVec
+	pcieLinkGen    *prometheus.GaugeVec
+	pcieLinkWidth  *prometheus.GaugeVec
+	pcieReplays    *prometheus.Desc
+
+	nvlinkActive  *prometheus.GaugeVec
+	nvlinkRxBytes *prometheus.Desc
+	nvlinkTxBytes *prometheus.Desc
+	nvlinkErrors  *prometheus.Desc
+
+	memoryTemperature    *prometheus.GaugeVec
+	temperatureThreshold *prometheus.GaugeVec
+	slowdownHeadroom     *prometheus.GaugeVec
+
+	fanSpeed         *prometheus.GaugeVec
+	fanTargetSpeed   *prometheus.GaugeVec
+	fanControlPolicy *prometheus.GaugeVec
+
+	energyTotal *prometheus.Desc
+	powerLimit  *prometheus.GaugeVec
+	// energy holds the integrated energy of devices without an energy
+	// counter, keyed by UUID.
+	energy map[string]*energyIntegrator
+
+	retiredPages        *prometheus.GaugeVec
+	retiredPagesPending *prometheus.GaugeVec
+	remappedRows        *prometheus.GaugeVec
+	remappedRowsPending *prometheus.GaugeVec
+	remappedRowsFailure *prometheus.GaugeVec
+
+	migUsedMemory  *prometheus.GaugeVec
+	migTotalMemory *prometheus.GaugeVec
+	migUtilization *prometheus.GaugeVec
+
+	vgpuInstances   *prometheus.GaugeVec
+	vgpuFBUsed      *prometheus.GaugeVec
+	vgpuSMUtil      *prometheus.GaugeVec
+	vgpuMemUtil     *prometheus.GaugeVec
+	vgpuEncUtil     *prometheus.GaugeVec
+	vgpuDecUtil     *prometheus.GaugeVec
+	vgpuEncSessions *prometheus.GaugeVec
+	vgpuEncFPS      *prometheus.GaugeVec
+	vgpuEncLatency  *prometheus.GaugeVec
+	vgpuFBCSessions *prometheus.GaugeVec
+	vgpuFBCFPS      *prometheus.GaugeVec
+	vgpuFBCLatency  *prometheus.GaugeVec
+
+	performanceState *prometheus.GaugeVec
+	computeMode      *prometheus.GaugeVec
+	persistenceMode  *prometheus.GaugeVec
+	displayActive    *prometheus.GaugeVec
+	displayMode      *prometheus.GaugeVec
+	accountingMode   *prometheus.GaugeVec
+
+	numaNode     *prometheus.GaugeVec
+	cpuAffinity  *prometheus.GaugeVec
+	topologyInfo *prometheus.GaugeVec
+	// topology caches the links between devices, keyed by UUID pair.
+	topology map[[2]string]*GPUTopologyLink
+
+	up      *prometheus.GaugeVec
+	healthy *prometheus.GaugeVec
+	// knownDevices holds the label values of every device seen, keyed by
+	// index, so that devices that can no longer be opened are still
+	// reported down.
+	knownDevices map[int][]string
+	// devices caches the open devices, keyed by UUID.
+	devices map[string]*cachedDevice
+
+	// XID metrics are updated by WatchXIDs and driver info by
+	// UpdateDriverInfo rather than by Collect, so they are never reset.
+	xidErrors         *prometheus.CounterVec
+	lastXID           *prometheus.GaugeVec
+	lastXIDTime       *prometheus.GaugeVec
+	driverInfo        *prometheus.GaugeVec
+	persistentMetrics []prometheus.Collector
+	// xidMu guards lastXIDAt, the time of the last XID error per UUID,
+	// which WatchXIDs updates concurrently with Collect. Only the XIDs in
+	// xidHealthCodes are recorded.
+	xidMu          sync.Mutex
+	lastXIDAt      map[string]time.Time
+	xidHealthCodes map[uint64]bool
+
+	// fields are the NVML fields configured with SetFields, keyed by id,
+	// and fieldIDs their ids in configuration order.
+	fields   map[uint32]fieldMetric
+	fieldIDs []uint32
+
+	// snapshot is the latest poll in polling mode, and nil otherwise.
+	snapshot   atomic.Pointer[snapshot]
+	lastUpdate *prometheus.Desc
+	// failedPolls counts the polls that failed since the last one that
+	// succeeded.
+	failedPolls int
+
 	allMetrics  []*prometheus.GaugeVec
 	allPMetrics []*prometheus.GaugeVec
+	allDescs    []*prometheus.Desc
 }
 
 func newGaugeVec(name, help string, labels []string) *prometheus.GaugeVec {
@@ -97,10 +372,36 @@ func newGaugeVec(name, help string, labels []string) *prometheus.GaugeVec {
 	)
 }
 
+func newDesc(name, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+}
+
+// withLabels returns a new slice holding base followed by extra, so that
+// the shared label slices are never appended to in place.
+func withLabels(base []string, extra ...string) []string {
+	out := make([]string, 0, len(base)+len(extra))
+	return append(append(out, base...), extra...)
+}
+
+// setOptional sets the gauge for lvs if v is non-nil.
+func setOptional(g *prometheus.GaugeVec, v *float64, lvs ...string) {
+	if v != nil {
+		g.WithLabelValues(lvs...).Set(*v)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func newCollector(nvmlClient NVMLClient, procFinder ProcessFinder) *Collector {
 	c := &Collector{
 		nvmlClient: nvmlClient,
 		procFinder: procFinder,
+		now:        time.Now,
 		numDevices: prometheus.NewGauge(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
@@ -108,25 +409,170 @@ func newCollector(nvmlClient NVMLClient, procFinder ProcessFinder) *Collector {
 				Help:      "Number of GPU devices",
 			},
 		),
-		usedMemory:   newGaugeVec("memory_used_bytes", "Memory used by the GPU device in bytes", labels),
-		totalMemory:  newGaugeVec("memory_total_bytes", "Total memory of the GPU device in bytes", labels),
-		dutyCycle:    newGaugeVec("duty_cycle", "Percent of time over the past sample period during which one or more kernels were executing on the GPU device", labels),
-		powerUsage:   newGaugeVec("power_usage_milliwatts", "Power usage of the GPU device in milliwatts", labels),
-		temperature:  newGaugeVec("temperature_celsius", "Temperature of the GPU device in celsius", labels),
-		encUtil:      newGaugeVec("encoder_utilization", "Encoder utilization of the GPU device in percent", labels),
-		decUtil:      newGaugeVec("decoder_utilization", "Decoder utilization of the GPU device in percent", labels),
-		pUsedMemory:  newGaugeVec("process_memory_used_bytes", "Memory used by GPU process in bytes", plabels),
-		pDecUtil:     newGaugeVec("process_decoder_utilization", "Decoder utilization of GPU process in percent", plabels),
-		pEncUtil:     newGaugeVec("process_encoder_utilization", "Encoder utilization of GPU process in percent", plabels),
-		pMemUtil:     newGaugeVec("process_memory_utilization", "Memory utilization of GPU process in percent", plabels),
-		pSmUtil:      newGaugeVec("process_sm_utilization", "SM utilization of GPU process in percent", plabels),
+		info:        newGaugeVec("info", "Identity of the GPU device, with a constant value of 1", withLabels(labels, infoLabels...)),
+		usedMemory:  newGaugeVec("memory_used_bytes", "Memory used by the GPU device in bytes", labels),
+		totalMemory: newGaugeVec("memory_total_bytes", "Total memory of the GPU device in bytes", labels),
+		freeMemory:  newGaugeVec("memory_free_bytes", "Free memory of the GPU device in bytes", labels),
+		resMemory:   newGaugeVec("memory_reserved_bytes", "Memory of the GPU device reserved by the driver in bytes", labels),
+		bar1Total:   newGaugeVec("bar1_memory_total_bytes", "Total BAR1 memory of the GPU device in bytes", labels),
+		bar1Used:    newGaugeVec("bar1_memory_used_bytes", "BAR1 memory used by the GPU device in bytes", labels),
+		bar1Free:    newGaugeVec("bar1_memory_free_bytes", "Free BAR1 memory of the GPU device in bytes", labels),
+		dutyCycle:   newGaugeVec("duty_cycle", "Percent of time over the past sample period during which one or more kernels were executing on the GPU device", labels),
+		powerUsage:  newGaugeVec("power_usage_milliwatts", "Power usage of the GPU device in milliwatts", labels),
+		temperature: newGaugeVec("temperature_celsius", "Temperature of the GPU device in celsius", labels),
+		encUtil:     newGaugeVec("encoder_utilization", "Encoder utilization of the GPU device in percent", labels),
+		decUtil:     newGaugeVec("decoder_utilization", "Decoder utilization of the GPU device in percent", labels),
+		pUsedMemory: newGaugeVec("process_memory_used_bytes", "Memory used by GPU process in bytes", plabels),
+		pDecUtil:    newGaugeVec("process_decoder_utilization", "Mean decoder utilization of GPU process in percent since the previous scrape", plabels),
+		pEncUtil:    newGaugeVec("process_encoder_utilization", "Mean encoder utilization of GPU process in percent since the previous scrape", plabels),
+		pMemUtil:    newGaugeVec("process_memory_utilization", "Mean memory utilization of GPU process in percent since the previous scrape", plabels),
+		pSmUtil:     newGaugeVec("process_sm_utilization", "Mean SM utilization of GPU process in percent since the previous scrape", plabels),
+		pDecUtilMax: newGaugeVec("process_decoder_utilization_max", "Max decoder utilization of GPU process in percent since the previous scrape", plabels),
+		pEncUtilMax: newGaugeVec("process_encoder_utilization_max", "Max encoder utilization of GPU process in percent since the previous scrape", plabels),
+		pMemUtilMax: newGaugeVec("process_memory_utilization_max", "Max memory utilization of GPU process in percent since the previous scrape", plabels),
+		pSmUtilMax:  newGaugeVec("process_sm_utilization_max", "Max SM utilization of GPU process in percent since the previous scrape", plabels),
+		lastSeen:    make(map[string]uint64),
+
+		encoderSessions: sessionGauges{
+			sessions:  newGaugeVec("encoder_sessions", "Active encoder sessions of the GPU device", labels),
+			fps:       newGaugeVec("encoder_average_fps", "Average frame rate of the encoder sessions of the GPU device", labels),
+			latency:   newGaugeVec("encoder_average_latency_seconds", "Average latency of the encoder sessions of the GPU device in seconds", labels),
+			pSessions: newGaugeVec("process_encoder_sessions", "Active encoder sessions of GPU process", plabels),
+			pFPS:      newGaugeVec("process_encoder_average_fps", "Average frame rate of the encoder sessions of GPU process", plabels),
+			pLatency:  newGaugeVec("process_encoder_average_latency_seconds", "Average latency of the encoder sessions of GPU process in seconds", plabels),
+		},
+		fbcSessions: sessionGauges{
+			sessions:  newGaugeVec("fbc_sessions", "Active frame buffer capture sessions of the GPU device", labels),
+			fps:       newGaugeVec("fbc_average_fps", "Average frame rate of the frame buffer capture sessions of the GPU device", labels),
+			latency:   newGaugeVec("fbc_average_latency_seconds", "Average latency of the frame buffer capture sessions of the GPU device in seconds", labels),
+			pSessions: newGaugeVec("process_fbc_sessions", "Active frame buffer capture sessions of GPU process", plabels),
+			pFPS:      newGaugeVec("process_fbc_average_fps", "Average frame rate of the frame buffer capture sessions of GPU process", plabels),
+			pLatency:  newGaugeVec("process_fbc_average_latency_seconds", "Average latency of the frame buffer capture sessions of GPU process in seconds", plabels),
+		},
+
+		acctMaxMemory:   newGaugeVec("process_accounting_max_memory_used_bytes", "Peak memory used by the GPU process in bytes, from accounting mode", acctlabels),
+		acctGPUUtil:     newGaugeVec("process_accounting_gpu_utilization", "GPU utilization of the GPU process in percent averaged over its lifetime, from accounting mode", acctlabels),
+		acctMemUtil:     newGaugeVec("process_accounting_memory_utilization", "Memory utilization of the GPU process in percent averaged over its lifetime, from accounting mode", acctlabels),
+		acctStartTime:   newGaugeVec("process_accounting_start_time_seconds", "Start time of the GPU process since the epoch, from accounting mode", acctlabels),
+		acctRunning:     newGaugeVec("process_accounting_running", "Whether the GPU process is still running (1 = running), from accounting mode", acctlabels),
+		acctRunTime:     newDesc("process_accounting_run_time_seconds_total", "Time the GPU process has run on the GPU device, from accounting mode", acctlabels),
+		accountedPIDs:   make(map[string]map[accountingKey]pidMeta),
+		accountingLimit: defaultAccountingLimit,
+
+		eccMode:              newGaugeVec("ecc_mode", "ECC mode of the GPU device (1 = enabled), for the current and the pending state", withLabels(labels, "state")),
+		clock:                newGaugeVec("clock_hz", "Clock frequency of the GPU device in hertz, per clock domain and type", withLabels(labels, "domain", "type")),
+		eccErrors:            newDesc("ecc_errors_total", "ECC errors reported by the GPU device", withLabels(labels, "error_type", "counter_type", "location")),
+		throttleReason:       newGaugeVec("clock_throttle_reason", "Whether the clocks of the GPU device are throttled for the given reason (1 = active)", withLabels(labels, "reason")),
+		throttleDuration:     newDesc("clock_throttle_duration_seconds_total", "Total time the GPU device spent throttled for the given reason in seconds", withLabels(labels, "reason")),
+		pcieThroughput:       newGaugeVec("pcie_throughput_bytes_per_second", "PCIe throughput of the GPU device in bytes per second, per direction (tx, rx)", withLabels(labels, "direction")),
+		pcieLinkGen:          newGaugeVec("pcie_link_generation", "PCIe link generation of the GPU device, current and max", withLabels(labels, "type")),
+		pcieLinkWidth:        newGaugeVec("pcie_link_width", "PCIe link width of the GPU device in lanes, current and max", withLabels(labels, "type")),
+		pcieReplays:          newDesc("pcie_replay_errors_total", "PCIe replay counter of the GPU device", labels),
+		nvlinkActive:         newGaugeVec("nvlink_active", "Whether the NVLink is active (1 = active), with the PCI bus id and UUID of the remote peer", withLabels(labels, "link", "remote_pci_bus_id", "remote_uuid")),
+		nvlinkRxBytes:        newDesc("nvlink_received_bytes_total", "Bytes received over the NVLink", withLabels(labels, "link")),
+		nvlinkTxBytes:        newDesc("nvlink_transmitted_bytes_total", "Bytes transmitted over the NVLink", withLabels(labels, "link")),
+		nvlinkErrors:         newDesc("nvlink_errors_total", "NVLink errors by type (crc_flit, crc_data, replay, recovery)", withLabels(labels, "link", "type")),
+		memoryTemperature:    newGaugeVec("memory_temperature_celsius", "Memory temperature of the GPU device in celsius", labels),
+		temperatureThreshold: newGaugeVec("temperature_threshold_celsius", "Thermal thresholds of the GPU device in celsius (shutdown, slowdown, memory_max, gpu_max)", withLabels(labels, "threshold")),
+		slowdownHeadroom:     newGaugeVec("temperature_slowdown_headroom_celsius", "Difference between the slowdown threshold and the temperature of the GPU device in celsius", labels),
+		fanSpeed:             newGaugeVec("fan_speed_percent", "Speed of the GPU device fan as a percentage of its maximum", withLabels(labels, "fan")),
+		fanTargetSpeed:       newGaugeVec("fan_target_speed_percent", "Target speed of the GPU device fan as a percentage of its maximum", withLabels(labels, "fan")),
+		fanControlPolicy:     newGaugeVec("fan_control_policy", "Control policy of the GPU device fan (1 = current policy)", withLabels(labels, "fan", "policy")),
+		energyTotal:          newDesc("energy_consumption_joules_total", "Energy consumed by the GPU device in joules, as reported by NVML or integrated by the exporter from power samples", withLabels(labels, "source")),
+		powerLimit:           newGaugeVec("power_limit_milliwatts", "Power limits of the GPU device in milliwatts, per type (management, enforced, default, min, max)", withLabels(labels, "type")),
+		energy:               make(map[string]*energyIntegrator),
+
+		retiredPages:        newGaugeVec("retired_pages", "Memory pages retired by the GPU device, per cause (single_bit_ecc, double_bit_ecc)", withLabels(labels, "cause")),
+		retiredPagesPending: newGaugeVec("retired_pages_pending", "Whether memory pages of the GPU device are pending retirement (1 = pending)", labels),
+		remappedRows:        newGaugeVec("remapped_rows", "Memory rows remapped by the GPU device, per cause (correctable, uncorrectable)", withLabels(labels, "cause")),
+		remappedRowsPending: newGaugeVec("remapped_rows_pending", "Whether a row remapping of the GPU device is pending a reset (1 = pending)", labels),
+		remappedRowsFailure: newGaugeVec("remapped_rows_failure", "Whether a row remapping of the GPU device has failed (1 = failed)", labels),
+
+		migUsedMemory:  newGaugeVec("mig_memory_used_bytes", "Memory used by the MIG instance in bytes", miglabels),
+		migTotalMemory: newGaugeVec("mig_memory_total_bytes", "Total memory of the MIG instance in bytes", miglabels),
+		migUtilization: newGaugeVec("mig_sm_utilization", "SM utilization of the MIG instance in percent", miglabels),
+
+		vgpuInstances:   newGaugeVec("vgpu_instances", "Number of active vGPU instances on the GPU device", labels),
+		vgpuFBUsed:      newGaugeVec("vgpu_framebuffer_used_bytes", "Framebuffer used by the vGPU instance in bytes", vgpulabels),
+		vgpuSMUtil:      newGaugeVec("vgpu_sm_utilization", "SM utilization of the vGPU instance in percent", vgpulabels),
+		vgpuMemUtil:     newGaugeVec("vgpu_memory_utilization", "Memory utilization of the vGPU instance in percent", vgpulabels),
+		vgpuEncUtil:     newGaugeVec("vgpu_encoder_utilization", "Encoder utilization of the vGPU instance in percent", vgpulabels),
+		vgpuDecUtil:     newGaugeVec("vgpu_decoder_utilization", "Decoder utilization of the vGPU instance in percent", vgpulabels),
+		vgpuEncSessions: newGaugeVec("vgpu_encoder_sessions", "Active encoder sessions of the vGPU instance", vgpulabels),
+		vgpuEncFPS:      newGaugeVec("vgpu_encoder_average_fps", "Average frame rate of the encoder sessions of the vGPU instance", vgpulabels),
+		vgpuEncLatency:  newGaugeVec("vgpu_encoder_average_latency_seconds", "Average latency of the encoder sessions of the vGPU instance in seconds", vgpulabels),
+		vgpuFBCSessions: newGaugeVec("vgpu_fbc_sessions", "Active frame buffer capture sessions of the vGPU instance", vgpulabels),
+		vgpuFBCFPS:      newGaugeVec("vgpu_fbc_average_fps", "Average frame rate of the frame buffer capture sessions of the vGPU instance", vgpulabels),
+		vgpuFBCLatency:  newGaugeVec("vgpu_fbc_average_latency_seconds", "Average latency of the frame buffer capture sessions of the vGPU instance in seconds", vgpulabels),
+
+		performanceState: newGaugeVec("performance_state", "Performance state (P-state) of the GPU device, from 0 (max performance) to 15", labels),
+		computeMode:      newGaugeVec("compute_mode", "Compute mode of the GPU device (1 for the current mode)", withLabels(labels, "mode")),
+		persistenceMode:  newGaugeVec("persistence_mode", "Whether persistence mode is enabled on the GPU device (1 = enabled)", labels),
+		displayActive:    newGaugeVec("display_active", "Whether a display is initialized on the GPU device (1 = active)", labels),
+		displayMode:      newGaugeVec("display_mode", "Whether a display is connected to the GPU device (1 = connected)", labels),
+		accountingMode:   newGaugeVec("accounting_mode", "Whether accounting mode is enabled on the GPU device (1 = enabled)", labels),
+
+		numaNode:     newGaugeVec("numa_node", "NUMA node the GPU device is attached to", labels),
+		cpuAffinity:  newGaugeVec("cpu_affinity_info", "CPUs local to the GPU device as a CPU list, with a constant value of 1", withLabels(labels, "cpus")),
+		topologyInfo: newGaugeVec("topology_info", "Connection between two GPU devices, with the closest level (nvlink or the common PCIe ancestor), the common PCIe ancestor and the number of NVLinks, with a constant value of 1", []string{"uuid", "peer_uuid", "level", "pcie", "nvlinks"}),
+		topology:     make(map[[2]string]*GPUTopologyLink),
+
+		up:           newGaugeVec("up", "Whether the GPU device could be read (1 = up)", labels),
+		healthy:      newGaugeVec("healthy", "Whether the GPU device is healthy (1 = healthy), with the reason it isn't", withLabels(labels, "reason")),
+		knownDevices: make(map[int][]string),
+		lastUpdate:   newDesc("last_update_timestamp_seconds", "Time NVML was last polled, in polling mode", nil),
+		devices:      make(map[string]*cachedDevice),
+
+		xidErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "xid_errors_total",
+				Help:      "Critical XID errors reported by the GPU device, per XID code",
+			},
+			withLabels(labels, "xid"),
+		),
+		lastXID:     newGaugeVec("last_xid_error", "Code of the last critical XID error reported by the GPU device", labels),
+		lastXIDTime: newGaugeVec("last_xid_error_timestamp_seconds", "Time of the last critical XID error reported by the GPU device", labels),
+		lastXIDAt:   make(map[string]time.Time),
+		driverInfo:  newGaugeVec("driver_info", "Versions of the NVIDIA driver, CUDA driver and NVML library, with a constant value of 1", []string{"driver_version", "cuda_driver_version", "nvml_version"}),
 	}
 	c.allMetrics = []*prometheus.GaugeVec{
-		c.usedMemory, c.totalMemory, c.dutyCycle,
+		c.info, c.usedMemory, c.totalMemory, c.dutyCycle,
+		c.freeMemory, c.resMemory, c.bar1Total, c.bar1Used, c.bar1Free,
 		c.powerUsage, c.temperature, c.encUtil, c.decUtil,
+		c.eccMode, c.clock, c.throttleReason,
+		c.pcieThroughput, c.pcieLinkGen, c.pcieLinkWidth,
+		c.nvlinkActive, c.powerLimit,
+		c.memoryTemperature, c.temperatureThreshold, c.slowdownHeadroom,
+		c.fanSpeed, c.fanTargetSpeed, c.fanControlPolicy,
+		c.retiredPages, c.retiredPagesPending,
+		c.remappedRows, c.remappedRowsPending, c.remappedRowsFailure,
+		c.migUsedMemory, c.migTotalMemory, c.migUtilization,
+		c.vgpuInstances, c.vgpuFBUsed, c.vgpuSMUtil, c.vgpuMemUtil, c.vgpuEncUtil, c.vgpuDecUtil,
+		c.vgpuEncSessions, c.vgpuEncFPS, c.vgpuEncLatency,
+		c.vgpuFBCSessions, c.vgpuFBCFPS, c.vgpuFBCLatency,
+		c.encoderSessions.sessions, c.encoderSessions.fps, c.encoderSessions.latency,
+		c.fbcSessions.sessions, c.fbcSessions.fps, c.fbcSessions.latency,
+		c.performanceState, c.computeMode, c.persistenceMode,
+		c.displayActive, c.displayMode, c.accountingMode,
+		c.numaNode, c.cpuAffinity, c.topologyInfo,
+		c.up, c.healthy,
 	}
 	c.allPMetrics = []*prometheus.GaugeVec{
 		c.pUsedMemory, c.pDecUtil, c.pEncUtil, c.pMemUtil, c.pSmUtil,
+		c.pDecUtilMax, c.pEncUtilMax, c.pMemUtilMax, c.pSmUtilMax,
+		c.acctMaxMemory, c.acctGPUUtil, c.acctMemUtil, c.acctStartTime, c.acctRunning,
+		c.encoderSessions.pSessions, c.encoderSessions.pFPS, c.encoderSessions.pLatency,
+		c.fbcSessions.pSessions, c.fbcSessions.pFPS, c.fbcSessions.pLatency,
+	}
+	c.SetXIDHealthCodes(defaultXIDHealthCodes)
+	c.persistentMetrics = []prometheus.Collector{
+		c.xidErrors, c.lastXID, c.lastXIDTime, c.driverInfo,
+	}
+	c.allDescs = []*prometheus.Desc{
+		c.eccErrors, c.throttleDuration, c.pcieReplays,
+		c.nvlinkRxBytes, c.nvlinkTxBytes, c.nvlinkErrors,
+		c.energyTotal, c.acctRunTime,
 	}
 	return c
 }
@@ -136,6 +582,16 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range append(c.allMetrics, c.allPMetrics...) {
 		m.Describe(ch)
 	}
+	for _, d := range c.allDescs {
+		ch <- d
+	}
+	for _, f := range c.fields {
+		ch <- f.desc
+	}
+	ch <- c.lastUpdate
+	for _, m := range c.persistentMetrics {
+		m.Describe(ch)
+	}
 }
 
 // parseContainerInfo parses process name in format "container@namespace/pod"
@@ -156,11 +612,125 @@ func parseContainerInfo(pName string) (container, namespace, pod string, ok bool
 	return container, namespace, pod, true
 }
 
+// UpdateDriverInfo refreshes nvidia_gpu_driver_info. It must be called
+// whenever NVML is (re)initialised, since the driver may have changed.
+func (c *Collector) UpdateDriverInfo() {
+	info, err := c.nvmlClient.GetDriverInfo()
+	if err != nil {
+		log.Printf("GetDriverInfo() error: %v", err)
+		return
+	}
+	c.driverInfo.Reset()
+	c.driverInfo.WithLabelValues(info.DriverVersion, info.CUDADriverVersion, info.NVMLVersion).Set(1)
+}
+
+// collectECC exports the ECC counters and mode reported in devStatus.
+// Counters are sent straight to ch since NVML already reports totals.
+func (c *Collector) collectECC(ch chan<- prometheus.Metric, lv []string, devStatus *GPUDeviceStatus) {
+	for _, e := range devStatus.ECCErrors {
+		ch <- prometheus.MustNewConstMetric(c.eccErrors, prometheus.CounterValue, e.Count,
+			withLabels(lv, e.ErrorType, e.CounterType, e.Location)...)
+	}
+	if devStatus.ECCMode != nil {
+		c.eccMode.WithLabelValues(withLabels(lv, "current")...).Set(boolToFloat(devStatus.ECCMode.Current))
+		c.eccMode.WithLabelValues(withLabels(lv, "pending")...).Set(boolToFloat(devStatus.ECCMode.Pending))
+	}
+}
+
+func (c *Collector) collectPCIe(ch chan<- prometheus.Metric, lv []string, pcie *GPUPCIeStatus) {
+	if pcie == nil {
+		return
+	}
+	setOptional(c.pcieThroughput, pcie.TxBytesPerSecond, withLabels(lv, "tx")...)
+	setOptional(c.pcieThroughput, pcie.RxBytesPerSecond, withLabels(lv, "rx")...)
+	setOptional(c.pcieLinkGen, pcie.LinkGeneration, withLabels(lv, "current")...)
+	setOptional(c.pcieLinkGen, pcie.MaxLinkGeneration, withLabels(lv, "max")...)
+	setOptional(c.pcieLinkWidth, pcie.LinkWidth, withLabels(lv, "current")...)
+	setOptional(c.pcieLinkWidth, pcie.MaxLinkWidth, withLabels(lv, "max")...)
+	if pcie.ReplayCounter != nil {
+		ch <- prometheus.MustNewConstMetric(c.pcieReplays, prometheus.CounterValue, *pcie.ReplayCounter, lv...)
+	}
+}
+
 type pidMeta struct {
 	container, namespace, pod string
+	processType               string
+	mig                       migPlacement
+}
+
+func (m pidMeta) labelValues(minor string) []string {
+	return []string{minor, m.pod, m.container, m.namespace, m.processType, m.mig.gpuInstanceID, m.mig.computeInstanceID}
+}
+
+type gpuProcess struct {
+	pid         uint
+	usedMemory  uint64
+	processType string
+}
+
+// runningProcesses merges the compute, MPS compute and graphics processes of
+// dev. A PID listed more than once is only kept with the first type it was
+// found under, so that its memory isn't counted twice.
+func runningProcesses(dev NVMLDevice) []gpuProcess {
+	var procs []gpuProcess
+	seen := make(map[uint]bool)
+	for _, l := range []struct {
+		processType string
+		call        string
+		get         func() ([]uint, []uint64, error)
+	}{
+		{processTypeCompute, "GetComputeRunningProcesses", dev.GetComputeRunningProcesses},
+		{processTypeMPS, "GetMPSComputeRunningProcesses", dev.GetMPSComputeRunningProcesses},
+		{processTypeGraphics, "GetGraphicsRunningProcesses", dev.GetGraphicsRunningProcesses},
+	} {
+		pids, mems, err := l.get()
+		if errors.Is(err, errNotSupported) {
+			continue
+		}
+		if err != nil {
+			log.Printf("%s() error: %v", l.call, err)
+			continue
+		}
+		for idx, pid := range pids {
+			if seen[pid] {
+				continue
+			}
+			seen[pid] = true
+			procs = append(procs, gpuProcess{pid: pid, usedMemory: mems[idx], processType: l.processType})
+		}
+	}
+	return procs
+}
+
+// resolvePID looks up the container of a GPU process. Processes that can't
+// be found or whose name doesn't follow the container@namespace/pod format
+// are recorded as orphans.
+func (c *Collector) resolvePID(pid uint) pidMeta {
+	p, err := c.procFinder.FindProcess(int(pid))
+	if err != nil || p == nil {
+		log.Printf("FindProcess(%d) failed, recording as orphan", pid)
+		return pidMeta{container: orphanContainer, namespace: orphanNamespace, pod: orphanPod}
+	}
+	container, namespace, pod, ok := parseContainerInfo(p.Executable())
+	if !ok {
+		log.Printf("Unexpected process name format for PID %d: %s", pid, p.Executable())
+		return pidMeta{container: orphanContainer, namespace: orphanNamespace, pod: orphanPod}
+	}
+	return pidMeta{container: container, namespace: namespace, pod: pod}
 }
 
+// Collect queries NVML, or in polling mode emits the latest snapshot.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if s := c.snapshot.Load(); s != nil {
+		c.collectSnapshot(ch, s)
+		return
+	}
+	c.collect(ch)
+}
+
+// collect queries NVML and sends the metrics to ch. It returns an error if
+// NVML couldn't be queried at all.
+func (c *Collector) collect(ch chan<- prometheus.Metric) error {
 	c.Lock()
 	defer c.Unlock()
 
@@ -171,28 +741,39 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	numDevices, err := c.nvmlClient.GetDeviceCount()
 	if err != nil {
 		log.Printf("DeviceCount() error: %v", err)
-		return
+		return err
 	}
 	c.numDevices.Set(float64(numDevices))
 	ch <- c.numDevices
 
+	var devs []topologyDevice
+	seen := make(map[string]bool)
+	defer c.pruneDevices(seen, int(numDevices))
 	for i := 0; i < int(numDevices); i++ {
-		dev, err := c.nvmlClient.NewDevice(uint(i))
+		d, err := c.device(i)
 		if err != nil {
 			log.Printf("DeviceHandleByIndex(%d) error: %v", i, err)
+			// A device that fell off the bus can't be opened any more;
+			// report it with the labels it had when it was last seen.
+			if lv, ok := c.knownDevices[i]; ok {
+				c.setHealth(lv, false, classifyNVMLError(err))
+			}
 			continue
 		}
 
-		minor := dev.GetMinor()
-		uuid := dev.GetUUID()
-		name := dev.GetModel()
-		lv := []string{minor, uuid, name}
+		dev, minor, uuid := d.dev, d.minor, d.uuid
+		lv := d.labelValues()
+		seen[uuid] = true
+		devs = append(devs, topologyDevice{dev: dev, uuid: uuid})
+		c.knownDevices[i] = lv
 
-		c.totalMemory.WithLabelValues(lv...).Set(dev.GetTotalMemory())
+		c.totalMemory.WithLabelValues(lv...).Set(d.totalMemory)
+		c.collectDeviceInfo(d, lv)
 
 		devStatus, err := dev.Status()
 		if err != nil {
 			log.Printf("Status() error for device %s: %v", uuid, err)
+			c.setHealth(lv, false, classifyNVMLError(err))
 			continue
 		}
 
@@ -203,54 +784,50 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 		c.encUtil.WithLabelValues(lv...).Set(devStatus.EncUtil)
 		c.decUtil.WithLabelValues(lv...).Set(devStatus.DecUtil)
 
-		pids, mem, err := dev.GetGraphicsRunningProcesses()
-		if err != nil {
-			log.Printf("GetGraphicsRunningProcesses() error: %v", err)
-			continue
+		setOptional(c.freeMemory, devStatus.FreeMemory, lv...)
+		setOptional(c.resMemory, devStatus.ReservedMemory, lv...)
+		if b := devStatus.BAR1; b != nil {
+			c.bar1Total.WithLabelValues(lv...).Set(b.Total)
+			c.bar1Used.WithLabelValues(lv...).Set(b.Used)
+			c.bar1Free.WithLabelValues(lv...).Set(b.Free)
 		}
 
-		pidInfo := make(map[int]pidMeta)
-		for idx, pid := range pids {
-			p, err := c.procFinder.FindProcess(int(pid))
-			if err != nil || p == nil {
-				log.Printf("FindProcess(%d) failed, recording as orphan", pid)
-				pidInfo[int(pid)] = pidMeta{orphanContainer, orphanNamespace, orphanPod}
-				c.pUsedMemory.WithLabelValues(minor, orphanPod, orphanContainer, orphanNamespace).
-					Set(float64(mem[idx]))
-				continue
-			}
-			container, namespace, pod, ok := parseContainerInfo(p.Executable())
-			if !ok {
-				log.Printf("Unexpected process name format for PID %d: %s", pid, p.Executable())
-				pidInfo[int(pid)] = pidMeta{orphanContainer, orphanNamespace, orphanPod}
-				c.pUsedMemory.WithLabelValues(minor, orphanPod, orphanContainer, orphanNamespace).
-					Set(float64(mem[idx]))
-				continue
-			}
-			pidInfo[int(pid)] = pidMeta{container, namespace, pod}
-			c.pUsedMemory.WithLabelValues(minor, pod, container, namespace).Set(float64(mem[idx]))
+		for _, clk := range devStatus.Clocks {
+			c.clock.WithLabelValues(withLabels(lv, clk.Domain, clk.Type)...).Set(clk.MHz * 1e6)
 		}
 
-		processUtilization, err := dev.GetProcessUtilization()
-		if err != nil {
-			log.Printf("GetProcessUtilization() error: %v", err)
-			continue
-		}
+		c.collectThermal(lv, devStatus)
+		c.collectFans(lv, devStatus.Fans)
+		c.collectECC(ch, lv, devStatus)
+		c.collectClockEventReasons(ch, lv, devStatus.ClockEventReasons)
+		c.collectPCIe(ch, lv, devStatus.PCIe)
+		c.collectEnergy(ch, uuid, lv, devStatus)
+		c.collectNVLinks(ch, dev, lv)
+		health := c.collectRetiredPages(dev, lv)
+		c.collectDeviceMode(dev, lv, devStatus)
+		c.collectFieldValues(ch, dev, lv)
+		migPlacements := c.collectMIG(dev, lv)
+		c.collectVGPUs(dev, lv)
 
-		for _, pu := range processUtilization {
-			if pu.PID == 0 {
-				continue
-			}
-			info, ok := pidInfo[int(pu.PID)]
-			if !ok {
-				continue
-			}
-			c.pDecUtil.WithLabelValues(minor, info.pod, info.container, info.namespace).Set(float64(pu.DecUtil))
-			c.pEncUtil.WithLabelValues(minor, info.pod, info.container, info.namespace).Set(float64(pu.EncUtil))
-			c.pMemUtil.WithLabelValues(minor, info.pod, info.container, info.namespace).Set(float64(pu.MemUtil))
-			c.pSmUtil.WithLabelValues(minor, info.pod, info.container, info.namespace).Set(float64(pu.SmUtil))
+		pidInfo := make(map[int]pidMeta)
+		usedMemory := make(map[pidMeta]uint64)
+		for _, proc := range runningProcesses(dev) {
+			info := c.resolvePID(proc.pid)
+			info.processType = proc.processType
+			info.mig = migPlacements[proc.pid]
+			pidInfo[int(proc.pid)] = info
+			usedMemory[info] += proc.usedMemory
+		}
+		for info, mem := range usedMemory {
+			c.pUsedMemory.WithLabelValues(info.labelValues(minor)...).Set(float64(mem))
 		}
+
+		c.collectProcessUtilization(dev, uuid, minor, pidInfo)
+		c.collectAccounting(ch, dev, uuid, minor, pidInfo)
+		c.collectSessions(dev, lv, minor, pidInfo)
+		c.setHealth(lv, true, c.healthReason(uuid, devStatus, health))
 	}
+	c.collectTopology(devs)
 
 	for _, m := range c.allMetrics {
 		m.Collect(ch)
@@ -258,4 +835,8 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	for _, m := range c.allPMetrics {
 		m.Collect(ch)
 	}
+	for _, m := range c.persistentMetrics {
+		m.Collect(ch)
+	}
+	return nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -44,6 +45,7 @@ func BenchmarkCollect_SingleDevice(b *testing.B) {
 		c.Collect(ch)
 		drainChannel(ch)
 	}
+	reportNewDeviceCalls(b, client)
 }
 
 func BenchmarkCollect_MultipleDevices(b *testing.B) {
@@ -71,6 +73,36 @@ func BenchmarkCollect_MultipleDevices(b *testing.B) {
 		c.Collect(ch)
 		drainChannel(ch)
 	}
+	reportNewDeviceCalls(b, client)
+}
+
+// BenchmarkCollect_DeviceOpenLatency compares scrapes of 8 devices that each
+// take 1ms to open, with the device cache and with the cache cleared before
+// every scrape as if each device were opened again.
+func BenchmarkCollect_DeviceOpenLatency(b *testing.B) {
+	for _, cached := range []bool{true, false} {
+		name := "cached"
+		if !cached {
+			name = "uncached"
+		}
+		b.Run(name, func(b *testing.B) {
+			client := newTestClient(8)
+			client.openLatency = time.Millisecond
+			c := makeTestCollector(client, &mockProcessFinder{})
+			ch := make(chan prometheus.Metric, 1024)
+			c.Collect(ch)
+			drainChannel(ch)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					clear(c.devices)
+				}
+				c.Collect(ch)
+				drainChannel(ch)
+			}
+		})
+	}
 }
 
 func BenchmarkCollect_ManyProcesses(b *testing.B) {
@@ -96,6 +128,7 @@ func BenchmarkCollect_ManyProcesses(b *testing.B) {
 		c.Collect(ch)
 		drainChannel(ch)
 	}
+	reportNewDeviceCalls(b, client)
 }
 
 func BenchmarkCollect_WithOrphans(b *testing.B) {
@@ -119,9 +152,9 @@ func BenchmarkCollect_WithOrphans(b *testing.B) {
 				minor: "0", uuid: "gpu-0", model: "NVIDIA Tesla V100",
 				totalMemory: 16384,
 				status:      &GPUDeviceStatus{UsedMemory: 8192, DutyCycle: 50, PowerUsage: 250000, Temperature: 65, EncUtil: 10, DecUtil: 20},
-				pids:     pids,
-				mems:    mems,
-				procUtil: makeProcUtil(50),
+				pids:        pids,
+				mems:        mems,
+				procUtil:    makeProcUtil(50),
 			},
 		},
 	}
@@ -133,6 +166,7 @@ func BenchmarkCollect_WithOrphans(b *testing.B) {
 		c.Collect(ch)
 		drainChannel(ch)
 	}
+	reportNewDeviceCalls(b, client)
 }
 
 // --- Bench helpers ---
@@ -180,6 +214,11 @@ func makeMockFinder(n int) *mockProcessFinder {
 	return finder
 }
 
+// reportNewDeviceCalls reports how often devices were opened per scrape.
+func reportNewDeviceCalls(b *testing.B, client *mockNVMLClient) {
+	b.ReportMetric(float64(client.newDeviceCalls)/float64(b.N), "newdevice/op")
+}
+
 func drainChannel(ch chan prometheus.Metric) {
 	for len(ch) > 0 {
 		<-ch
@@ -3,77 +3,1147 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	ps "github.com/vaniot-s/go-ps"
-	"github.com/vaniot-s/nvml"
 )
 
 // NewCollector creates a Collector with real NVML and process lookup backends.
-func NewCollector() *Collector {
-	return newCollector(&realNVMLClient{}, &realProcessFinder{})
+// lib must be initialized before the collector is used.
+func NewCollector(lib nvml.Interface) *Collector {
+	return newCollector(&realNVMLClient{lib: lib}, &realProcessFinder{})
+}
+
+// nvmlError converts an NVML return code into an error, or nil on success.
+// Codes the collector handles specially are mapped to their sentinel errors.
+func nvmlError(ret nvml.Return) error {
+	switch ret {
+	case nvml.SUCCESS:
+		return nil
+	case nvml.ERROR_NOT_SUPPORTED:
+		return errNotSupported
+	case nvml.ERROR_GPU_IS_LOST:
+		return errGPULost
+	case nvml.ERROR_RESET_REQUIRED:
+		return errResetRequired
+	}
+	return fmt.Errorf("nvml: %v", ret)
+}
+
+// optional returns v multiplied by scale, or nil if ret reports that v
+// couldn't be read.
+func optional[T uint32 | uint64 | int](v T, ret nvml.Return, scale float64) *float64 {
+	if ret != nvml.SUCCESS {
+		return nil
+	}
+	f := float64(v) * scale
+	return &f
+}
+
+// fieldValue decodes the value of an NVML field multiplied by scale, or
+// returns nil if the device didn't report it.
+func fieldValue(v nvml.FieldValue, scale float64) *float64 {
+	if nvml.Return(v.NvmlReturn) != nvml.SUCCESS {
+		return nil
+	}
+	return decodeValue(nvml.ValueType(v.ValueType), v.Value, scale)
+}
+
+// decodeValue decodes an NVML value union of type typ multiplied by scale, or
+// returns nil if the type is unknown.
+func decodeValue(typ nvml.ValueType, v [8]byte, scale float64) *float64 {
+	var f float64
+	switch typ {
+	case nvml.VALUE_TYPE_DOUBLE:
+		f = math.Float64frombits(binary.NativeEndian.Uint64(v[:]))
+	case nvml.VALUE_TYPE_UNSIGNED_INT:
+		f = float64(binary.NativeEndian.Uint32(v[:]))
+	case nvml.VALUE_TYPE_UNSIGNED_LONG, nvml.VALUE_TYPE_UNSIGNED_LONG_LONG:
+		f = float64(binary.NativeEndian.Uint64(v[:]))
+	case nvml.VALUE_TYPE_SIGNED_LONG_LONG:
+		f = float64(int64(binary.NativeEndian.Uint64(v[:])))
+	case nvml.VALUE_TYPE_SIGNED_INT:
+		f = float64(int32(binary.NativeEndian.Uint32(v[:])))
+	default:
+		return nil
+	}
+	f *= scale
+	return &f
+}
+
+// cString converts a NUL terminated C char array into a string.
+func cString(b []int8) string {
+	s := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c == 0 {
+			break
+		}
+		s = append(s, byte(c))
+	}
+	return string(s)
 }
 
 // --- Concrete NVML implementation ---
 
-type realNVMLClient struct{}
+type realNVMLClient struct {
+	lib nvml.Interface
+}
 
 func (c *realNVMLClient) GetDeviceCount() (uint, error) {
-	return nvml.GetDeviceCount()
+	n, ret := c.lib.DeviceGetCount()
+	if err := nvmlError(ret); err != nil {
+		return 0, err
+	}
+	return uint(n), nil
+}
+
+// GetDeviceUUID only reads the UUID of the device; NVML hands out device
+// handles without querying the device.
+func (c *realNVMLClient) GetDeviceUUID(idx uint) (string, error) {
+	dev, ret := c.lib.DeviceGetHandleByIndex(int(idx))
+	if err := nvmlError(ret); err != nil {
+		return "", err
+	}
+	uuid, ret := dev.GetUUID()
+	return uuid, nvmlError(ret)
 }
 
 func (c *realNVMLClient) NewDevice(idx uint) (NVMLDevice, error) {
-	dev, err := nvml.NewDevice(idx)
-	if err != nil {
+	dev, ret := c.lib.DeviceGetHandleByIndex(int(idx))
+	if err := nvmlError(ret); err != nil {
 		return nil, err
 	}
-	return &realNVMLDevice{dev: dev}, nil
+	return newRealNVMLDevice(c.lib, dev)
 }
 
+// GetDriverInfo reports the driver, CUDA driver and NVML library versions.
+func (c *realNVMLClient) GetDriverInfo() (*GPUDriverInfo, error) {
+	driver, ret := c.lib.SystemGetDriverVersion()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	cuda, ret := c.lib.SystemGetCudaDriverVersion()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	nvmlVersion, ret := c.lib.SystemGetNVMLVersion()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	return &GPUDriverInfo{
+		DriverVersion: driver,
+		// NVML encodes the CUDA version as 1000 * major + 10 * minor.
+		CUDADriverVersion: fmt.Sprintf("%d.%d", cuda/1000, cuda%1000/10),
+		NVMLVersion:       nvmlVersion,
+	}, nil
+}
+
+// realNVMLDevice is an NVML device handle along with the static attributes
+// read when it was opened.
 type realNVMLDevice struct {
-	dev *nvml.Device
+	lib         nvml.Interface
+	dev         nvml.Device
+	minor       string
+	uuid        string
+	model       string
+	totalMemory float64
+	busID       string
+}
+
+func newRealNVMLDevice(lib nvml.Interface, dev nvml.Device) (*realNVMLDevice, error) {
+	minor, ret := dev.GetMinorNumber()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	uuid, ret := dev.GetUUID()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	model, ret := dev.GetName()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	mem, ret := dev.GetMemoryInfo()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	pci, ret := dev.GetPciInfo()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	return &realNVMLDevice{
+		lib:         lib,
+		dev:         dev,
+		minor:       strconv.Itoa(minor),
+		uuid:        uuid,
+		model:       model,
+		totalMemory: float64(mem.Total),
+		busID:       cString(pci.BusId[:]),
+	}, nil
 }
 
-func (d *realNVMLDevice) GetMinor() string      { return strconv.Itoa(int(*d.dev.Minor)) }
-func (d *realNVMLDevice) GetUUID() string       { return d.dev.UUID }
-func (d *realNVMLDevice) GetModel() string      { return *d.dev.Model }
-func (d *realNVMLDevice) GetTotalMemory() float64 { return float64(*d.dev.Memory) }
+func (d *realNVMLDevice) GetMinor() string        { return d.minor }
+func (d *realNVMLDevice) GetUUID() string         { return d.uuid }
+func (d *realNVMLDevice) GetModel() string        { return d.model }
+func (d *realNVMLDevice) GetTotalMemory() float64 { return d.totalMemory }
 
+// Status reads the dynamic state of the device. Only a failure to read the
+// memory usage fails it; the other values are left unset, or zero for the
+// ones that aren't optional, when the device doesn't report them.
 func (d *realNVMLDevice) Status() (*GPUDeviceStatus, error) {
-	s, err := d.dev.Status()
+	used, free, reserved, err := memoryInfo(d.dev)
 	if err != nil {
 		return nil, err
 	}
-	return &GPUDeviceStatus{
-		UsedMemory:  float64(*s.Memory.Global.Used),
-		DutyCycle:   float64(*s.Utilization.GPU),
-		PowerUsage:  float64(*s.Power),
-		Temperature: float64(*s.Temperature),
-		EncUtil:     float64(*s.Utilization.Encoder),
-		DecUtil:     float64(*s.Utilization.Decoder),
-	}, nil
+	s := &GPUDeviceStatus{
+		UsedMemory:            used,
+		FreeMemory:            &free,
+		ReservedMemory:        reserved,
+		BAR1:                  bar1Memory(d.dev),
+		ECCMode:               eccMode(d.dev),
+		Clocks:                clocks(d.dev),
+		ClockEventReasons:     throttleReasons(d.dev),
+		PCIe:                  pcieStatus(d.dev),
+		PerformanceState:      performanceState(d.dev),
+		PowerLimits:           powerLimits(d.dev),
+		MemoryTemperature:     memoryTemperature(d.dev),
+		TemperatureThresholds: temperatureThresholds(d.dev),
+		Fans:                  fans(d.dev),
+	}
+	if s.ECCMode != nil && s.ECCMode.Current {
+		s.ECCErrors = eccErrorCounts(d.dev)
+	}
+	if u, ret := d.dev.GetUtilizationRates(); ret == nvml.SUCCESS {
+		s.DutyCycle = float64(u.Gpu)
+	}
+	if p, ret := d.dev.GetPowerUsage(); ret == nvml.SUCCESS {
+		s.PowerUsage = float64(p)
+	}
+	energy, ret := d.dev.GetTotalEnergyConsumption()
+	s.EnergyJoules = optional(energy, ret, 1e-3) // millijoules
+	if t, ret := d.dev.GetTemperature(nvml.TEMPERATURE_GPU); ret == nvml.SUCCESS {
+		s.Temperature = float64(t)
+	}
+	if u, _, ret := d.dev.GetEncoderUtilization(); ret == nvml.SUCCESS {
+		s.EncUtil = float64(u)
+	}
+	if u, _, ret := d.dev.GetDecoderUtilization(); ret == nvml.SUCCESS {
+		s.DecUtil = float64(u)
+	}
+	return s, nil
+}
+
+// memoryInfo reads the memory usage of dev in bytes with the v2 API, which
+// splits the memory reserved by the driver out of the used memory. Drivers
+// without it fall back to the v1 API, and reserved is nil.
+func memoryInfo(dev nvml.Device) (used, free float64, reserved *float64, err error) {
+	mem, ret := dev.GetMemoryInfo_v2()
+	switch ret {
+	case nvml.SUCCESS:
+		return float64(mem.Used), float64(mem.Free), optional(mem.Reserved, ret, 1), nil
+	case nvml.ERROR_NOT_SUPPORTED, nvml.ERROR_FUNCTION_NOT_FOUND, nvml.ERROR_ARGUMENT_VERSION_MISMATCH:
+	default:
+		return 0, 0, nil, nvmlError(ret)
+	}
+	v1, ret := dev.GetMemoryInfo()
+	if err := nvmlError(ret); err != nil {
+		return 0, 0, nil, err
+	}
+	return float64(v1.Used), float64(v1.Free), nil, nil
+}
+
+// memoryTemperature reads the temperature of the HBM memory of dev, which
+// NVML only reports as a field value.
+func memoryTemperature(dev nvml.Device) *float64 {
+	values := []nvml.FieldValue{{FieldId: nvml.FI_DEV_MEMORY_TEMP}}
+	if dev.GetFieldValues(values) != nvml.SUCCESS {
+		return nil
+	}
+	return fieldValue(values[0], 1)
+}
+
+func temperatureThresholds(dev nvml.Device) *GPUTemperatureThresholds {
+	t := &GPUTemperatureThresholds{}
+	for _, v := range []struct {
+		dst       **float64
+		threshold nvml.TemperatureThresholds
+	}{
+		{&t.Shutdown, nvml.TEMPERATURE_THRESHOLD_SHUTDOWN},
+		{&t.Slowdown, nvml.TEMPERATURE_THRESHOLD_SLOWDOWN},
+		{&t.MemoryMax, nvml.TEMPERATURE_THRESHOLD_MEM_MAX},
+		{&t.GPUMax, nvml.TEMPERATURE_THRESHOLD_GPU_MAX},
+	} {
+		c, ret := dev.GetTemperatureThreshold(v.threshold)
+		*v.dst = optional(c, ret, 1)
+	}
+	if *t == (GPUTemperatureThresholds{}) {
+		return nil
+	}
+	return t
+}
+
+// fans reads the speed and control policy of each fan of dev. Passively
+// cooled devices report no fans.
+func fans(dev nvml.Device) []GPUFan {
+	n, ret := dev.GetNumFans()
+	if ret != nvml.SUCCESS {
+		return nil
+	}
+	fans := make([]GPUFan, n)
+	for i := range fans {
+		fans[i].Fan = i
+		speed, ret := dev.GetFanSpeed_v2(i)
+		fans[i].SpeedPercent = optional(speed, ret, 1)
+		target, ret := dev.GetTargetFanSpeed(i)
+		fans[i].TargetSpeedPercent = optional(target, ret, 1)
+		switch policy, ret := dev.GetFanControlPolicy_v2(i); {
+		case ret != nvml.SUCCESS:
+		case policy == nvml.FAN_POLICY_TEMPERATURE_CONTINOUS_SW:
+			fans[i].ControlPolicy = fanControlPolicyAuto
+		case policy == nvml.FAN_POLICY_MANUAL:
+			fans[i].ControlPolicy = fanControlPolicyManual
+		}
+	}
+	return fans
+}
+
+func performanceState(dev nvml.Device) *float64 {
+	p, ret := dev.GetPerformanceState()
+	if ret != nvml.SUCCESS || p > nvml.PSTATE_15 {
+		return nil
+	}
+	f := float64(p)
+	return &f
+}
+
+// pcieStatus reads the PCIe throughput of dev, which NVML reports in KB/s,
+// along with the link generation and width and the replay counter.
+func pcieStatus(dev nvml.Device) *GPUPCIeStatus {
+	tx, txRet := dev.GetPcieThroughput(nvml.PCIE_UTIL_TX_BYTES)
+	rx, rxRet := dev.GetPcieThroughput(nvml.PCIE_UTIL_RX_BYTES)
+	gen, genRet := dev.GetCurrPcieLinkGeneration()
+	maxGen, maxGenRet := dev.GetMaxPcieLinkGeneration()
+	width, widthRet := dev.GetCurrPcieLinkWidth()
+	maxWidth, maxWidthRet := dev.GetMaxPcieLinkWidth()
+	replays, replaysRet := dev.GetPcieReplayCounter()
+	p := &GPUPCIeStatus{
+		TxBytesPerSecond:  optional(tx, txRet, 1e3),
+		RxBytesPerSecond:  optional(rx, rxRet, 1e3),
+		LinkGeneration:    optional(gen, genRet, 1),
+		MaxLinkGeneration: optional(maxGen, maxGenRet, 1),
+		LinkWidth:         optional(width, widthRet, 1),
+		MaxLinkWidth:      optional(maxWidth, maxWidthRet, 1),
+		ReplayCounter:     optional(replays, replaysRet, 1),
+	}
+	if *p == (GPUPCIeStatus{}) {
+		return nil
+	}
+	return p
+}
+
+// powerLimits reads the power limits of dev. They are read on every scrape,
+// since they can be changed at any time with nvidia-smi.
+func powerLimits(dev nvml.Device) *GPUPowerLimits {
+	management, managementRet := dev.GetPowerManagementLimit()
+	enforced, enforcedRet := dev.GetEnforcedPowerLimit()
+	def, defRet := dev.GetPowerManagementDefaultLimit()
+	minLimit, maxLimit, constraintsRet := dev.GetPowerManagementLimitConstraints()
+	l := &GPUPowerLimits{
+		ManagementLimit: optional(management, managementRet, 1),
+		EnforcedLimit:   optional(enforced, enforcedRet, 1),
+		DefaultLimit:    optional(def, defRet, 1),
+		MinLimit:        optional(minLimit, constraintsRet, 1),
+		MaxLimit:        optional(maxLimit, constraintsRet, 1),
+	}
+	if *l == (GPUPowerLimits{}) {
+		return nil
+	}
+	return l
+}
+
+func bar1Memory(dev nvml.Device) *GPUBAR1Memory {
+	b, ret := dev.GetBAR1MemoryInfo()
+	if ret != nvml.SUCCESS {
+		return nil
+	}
+	return &GPUBAR1Memory{
+		Total: float64(b.Bar1Total),
+		Used:  float64(b.Bar1Used),
+		Free:  float64(b.Bar1Free),
+	}
+}
+
+// throttleReasons reads the bitmask of the reasons the clocks of dev are held
+// down, whose bits are the same as the clockEvent* values, along with the time
+// spent throttled by the power cap and sync boost, the only reasons NVML keeps
+// violation counters for.
+func throttleReasons(dev nvml.Device) *GPUClockEventReasons {
+	mask, ret := dev.GetCurrentClocksThrottleReasons()
+	if ret != nvml.SUCCESS {
+		return nil
+	}
+	r := &GPUClockEventReasons{Active: mask}
+	for _, v := range []struct {
+		reason uint64
+		policy nvml.PerfPolicyType
+	}{
+		{clockEventSwPowerCap, nvml.PERF_POLICY_POWER},
+		{clockEventSyncBoost, nvml.PERF_POLICY_SYNC_BOOST},
+	} {
+		t, ret := dev.GetViolationStatus(v.policy)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		if r.Durations == nil {
+			r.Durations = make(map[uint64]float64)
+		}
+		r.Durations[v.reason] = float64(t.ViolationTime) / 1e9 // nanoseconds
+	}
+	return r
+}
+
+// clocks reads the current, application and max clocks of every clock domain
+// of dev. Clocks the device doesn't report are skipped.
+func clocks(dev nvml.Device) []GPUClock {
+	var clocks []GPUClock
+	for _, domain := range []struct {
+		name  string
+		clock nvml.ClockType
+	}{
+		{clockDomainGraphics, nvml.CLOCK_GRAPHICS},
+		{clockDomainSM, nvml.CLOCK_SM},
+		{clockDomainMemory, nvml.CLOCK_MEM},
+		{clockDomainVideo, nvml.CLOCK_VIDEO},
+	} {
+		for _, t := range []struct {
+			name string
+			get  func(nvml.ClockType) (uint32, nvml.Return)
+		}{
+			{clockCurrent, dev.GetClockInfo},
+			{clockApplication, dev.GetApplicationsClock},
+			{clockMax, dev.GetMaxClockInfo},
+		} {
+			mhz, ret := t.get(domain.clock)
+			if ret != nvml.SUCCESS {
+				continue
+			}
+			clocks = append(clocks, GPUClock{Domain: domain.name, Type: t.name, MHz: float64(mhz)})
+		}
+	}
+	return clocks
+}
+
+// eccMode reads the current and pending ECC mode of dev, or returns nil if
+// the device doesn't support ECC.
+func eccMode(dev nvml.Device) *GPUECCMode {
+	current, pending, ret := dev.GetEccMode()
+	if ret != nvml.SUCCESS {
+		return nil
+	}
+	return &GPUECCMode{
+		Current: current == nvml.FEATURE_ENABLED,
+		Pending: pending == nvml.FEATURE_ENABLED,
+	}
+}
+
+// eccErrorCounts reads every ECC counter of dev: corrected (single bit) and
+// uncorrected (double bit) errors, volatile and aggregate, for each memory
+// location. Counters the device doesn't have are skipped.
+func eccErrorCounts(dev nvml.Device) []GPUECCErrorCount {
+	var counts []GPUECCErrorCount
+	for _, e := range []struct {
+		name string
+		typ  nvml.MemoryErrorType
+	}{
+		{eccSingleBit, nvml.MEMORY_ERROR_TYPE_CORRECTED},
+		{eccDoubleBit, nvml.MEMORY_ERROR_TYPE_UNCORRECTED},
+	} {
+		for _, c := range []struct {
+			name string
+			typ  nvml.EccCounterType
+		}{
+			{eccVolatile, nvml.VOLATILE_ECC},
+			{eccAggregate, nvml.AGGREGATE_ECC},
+		} {
+			for _, l := range []struct {
+				name     string
+				location nvml.MemoryLocation
+			}{
+				{eccLocationDeviceMemory, nvml.MEMORY_LOCATION_DEVICE_MEMORY},
+				{eccLocationL1Cache, nvml.MEMORY_LOCATION_L1_CACHE},
+				{eccLocationL2Cache, nvml.MEMORY_LOCATION_L2_CACHE},
+				{eccLocationRegisterFile, nvml.MEMORY_LOCATION_REGISTER_FILE},
+			} {
+				n, ret := dev.GetMemoryErrorCounter(e.typ, c.typ, l.location)
+				if ret != nvml.SUCCESS {
+					continue
+				}
+				counts = append(counts, GPUECCErrorCount{
+					ErrorType:   e.name,
+					CounterType: c.name,
+					Location:    l.name,
+					Count:       float64(n),
+				})
+			}
+		}
+	}
+	return counts
+}
+
+// valueNotAvailable is reported by NVML for the memory of processes it can't
+// account, e.g. under WDDM.
+const valueNotAvailable = ^uint64(0)
+
+// processes converts the processes listed by NVML into PIDs and their used
+// memory in bytes.
+func processes(infos []nvml.ProcessInfo, ret nvml.Return) ([]uint, []uint64, error) {
+	if err := nvmlError(ret); err != nil {
+		return nil, nil, err
+	}
+	pids := make([]uint, len(infos))
+	mems := make([]uint64, len(infos))
+	for i, p := range infos {
+		pids[i] = uint(p.Pid)
+		if p.UsedGpuMemory != valueNotAvailable {
+			mems[i] = p.UsedGpuMemory
+		}
+	}
+	return pids, mems, nil
+}
+
+func (d *realNVMLDevice) GetComputeRunningProcesses() ([]uint, []uint64, error) {
+	return processes(d.dev.GetComputeRunningProcesses())
+}
+
+func (d *realNVMLDevice) GetMPSComputeRunningProcesses() ([]uint, []uint64, error) {
+	return processes(d.dev.GetMPSComputeRunningProcesses())
 }
 
 func (d *realNVMLDevice) GetGraphicsRunningProcesses() ([]uint, []uint64, error) {
-	return d.dev.GetGraphicsRunningProcesses()
+	return processes(d.dev.GetGraphicsRunningProcesses())
+}
+
+func (d *realNVMLDevice) GetProcessUtilization(lastSeen uint64) ([]GPUProcessUtilization, error) {
+	samples, ret := d.dev.GetProcessUtilization(lastSeen)
+	switch ret {
+	case nvml.SUCCESS, nvml.ERROR_INSUFFICIENT_SIZE:
+		// The bindings report an empty buffer as insufficient size.
+	case nvml.ERROR_NOT_FOUND:
+		// No sample was taken since lastSeen.
+		return nil, nil
+	default:
+		return nil, nvmlError(ret)
+	}
+	result := make([]GPUProcessUtilization, 0, len(samples))
+	for _, s := range samples {
+		result = append(result, GPUProcessUtilization{
+			PID:       uint(s.Pid),
+			DecUtil:   uint(s.DecUtil),
+			EncUtil:   uint(s.EncUtil),
+			MemUtil:   uint(s.MemUtil),
+			SmUtil:    uint(s.SmUtil),
+			TimeStamp: s.TimeStamp,
+		})
+	}
+	return result, nil
 }
 
-func (d *realNVMLDevice) GetProcessUtilization() ([]GPUProcessUtilization, error) {
-	samples, err := d.dev.GetProcessUtilization()
+// GetNVLinks reports the state, peer and counters of every NVLink of the
+// device. NVML reports the links a device doesn't have as not supported.
+func (d *realNVMLDevice) GetNVLinks() ([]GPUNVLink, error) {
+	var links []GPUNVLink
+	for l := 0; l < nvml.NVLINK_MAX_LINKS; l++ {
+		state, ret := d.dev.GetNvLinkState(l)
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			continue
+		}
+		if err := nvmlError(ret); err != nil {
+			return nil, err
+		}
+		link := GPUNVLink{Link: uint(l), Active: state == nvml.FEATURE_ENABLED}
+		if link.Active {
+			link.RemoteBusID, link.RemoteUUID = d.nvLinkPeer(l)
+		}
+		for _, e := range []struct {
+			dst     **float64
+			counter nvml.NvLinkErrorCounter
+		}{
+			{&link.CRCFlitErrors, nvml.NVLINK_ERROR_DL_CRC_FLIT},
+			{&link.CRCDataErrors, nvml.NVLINK_ERROR_DL_CRC_DATA},
+			{&link.ReplayErrors, nvml.NVLINK_ERROR_DL_REPLAY},
+			{&link.RecoveryErrors, nvml.NVLINK_ERROR_DL_RECOVERY},
+		} {
+			n, ret := d.dev.GetNvLinkErrorCounter(l, e.counter)
+			*e.dst = optional(n, ret, 1)
+		}
+		links = append(links, link)
+	}
+	if len(links) == 0 {
+		return nil, errNotSupported
+	}
+
+	// The data throughput counters are field values in KiB, scoped by link.
+	values := make([]nvml.FieldValue, 0, 2*len(links))
+	for _, l := range links {
+		values = append(values,
+			nvml.FieldValue{FieldId: nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_RX, ScopeId: uint32(l.Link)},
+			nvml.FieldValue{FieldId: nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_TX, ScopeId: uint32(l.Link)})
+	}
+	if d.dev.GetFieldValues(values) == nvml.SUCCESS {
+		for i := range links {
+			links[i].RxBytes = fieldValue(values[2*i], 1024)
+			links[i].TxBytes = fieldValue(values[2*i+1], 1024)
+		}
+	}
+	return links, nil
+}
+
+// nvLinkPeer returns the PCI bus id of the device at the other end of link,
+// and its UUID if it is a GPU.
+func (d *realNVMLDevice) nvLinkPeer(link int) (busID, uuid string) {
+	pci, ret := d.dev.GetNvLinkRemotePciInfo(link)
+	if ret != nvml.SUCCESS {
+		return "", ""
+	}
+	busID = cString(pci.BusId[:])
+	// NVSwitches and CPUs have no device handle.
+	if peer, ret := d.lib.DeviceGetHandleByPciBusId(busID); ret == nvml.SUCCESS {
+		uuid, _ = peer.GetUUID()
+	}
+	return busID, uuid
+}
+
+// GetRetiredPages reports the pages retired for each ECC error cause and
+// whether more are pending retirement.
+func (d *realNVMLDevice) GetRetiredPages() (*GPURetiredPages, error) {
+	sbe, ret := d.dev.GetRetiredPages(nvml.PAGE_RETIREMENT_CAUSE_MULTIPLE_SINGLE_BIT_ECC_ERRORS)
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	dbe, ret := d.dev.GetRetiredPages(nvml.PAGE_RETIREMENT_CAUSE_DOUBLE_BIT_ECC_ERROR)
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	pending, ret := d.dev.GetRetiredPagesPendingStatus()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	return &GPURetiredPages{
+		SingleBitECC: float64(len(sbe)),
+		DoubleBitECC: float64(len(dbe)),
+		Pending:      pending == nvml.FEATURE_ENABLED,
+	}, nil
+}
+
+// GetRemappedRows reports the rows remapped after ECC errors, and whether a
+// remapping is pending or has failed.
+func (d *realNVMLDevice) GetRemappedRows() (*GPURemappedRows, error) {
+	corr, unc, pending, failure, ret := d.dev.GetRemappedRows()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	return &GPURemappedRows{
+		Correctable:   float64(corr),
+		Uncorrectable: float64(unc),
+		Pending:       pending,
+		Failure:       failure,
+	}, nil
+}
+
+// GetMIGDevices lists the MIG instances of the device along with the
+// processes running on each. Devices with MIG disabled report
+// errNotSupported.
+func (d *realNVMLDevice) GetMIGDevices() ([]GPUMIGDevice, error) {
+	mode, _, ret := d.dev.GetMigMode()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	if mode != nvml.DEVICE_MIG_ENABLE {
+		return nil, errNotSupported
+	}
+	count, ret := d.dev.GetMaxMigDeviceCount()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	var devices []GPUMIGDevice
+	for i := 0; i < count; i++ {
+		mig, ret := d.dev.GetMigDeviceHandleByIndex(i)
+		if ret == nvml.ERROR_NOT_FOUND {
+			// The indices of destroyed instances are left empty.
+			continue
+		}
+		if err := nvmlError(ret); err != nil {
+			return nil, err
+		}
+		m, err := migDevice(mig)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, *m)
+	}
+	return devices, nil
+}
+
+// migDevice reads the identity, memory usage and processes of a MIG device
+// handle.
+func migDevice(mig nvml.Device) (*GPUMIGDevice, error) {
+	gi, ret := mig.GetGpuInstanceId()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	ci, ret := mig.GetComputeInstanceId()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	uuid, ret := mig.GetUUID()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	mem, ret := mig.GetMemoryInfo()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	m := &GPUMIGDevice{
+		GPUInstanceID:     uint(gi),
+		ComputeInstanceID: uint(ci),
+		UUID:              uuid,
+		TotalMemory:       float64(mem.Total),
+		UsedMemory:        float64(mem.Used),
+	}
+	// MIG devices are named after their parent and profile, e.g.
+	// "NVIDIA A100-SXM4-40GB MIG 1g.5gb".
+	if name, ret := mig.GetName(); ret == nvml.SUCCESS {
+		if i := strings.LastIndex(name, " MIG "); i >= 0 {
+			m.Profile = name[i+len(" MIG "):]
+		}
+	}
+	u, ret := mig.GetUtilizationRates()
+	m.Utilization = optional(u.Gpu, ret, 1)
+	pids, _, err := processes(mig.GetComputeRunningProcesses())
+	if err != nil && !errors.Is(err, errNotSupported) {
+		return nil, err
+	}
+	m.PIDs = pids
+	return m, nil
+}
+
+// GetVGPUInstances lists the active vGPU instances of a device in vGPU host
+// mode, with their latest utilization sample.
+func (d *realNVMLDevice) GetVGPUInstances() ([]GPUVGPUInstance, error) {
+	mode, ret := d.dev.GetVirtualizationMode()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	if mode != nvml.GPU_VIRTUALIZATION_MODE_HOST_VGPU {
+		return nil, errNotSupported
+	}
+	active, ret := d.dev.GetActiveVgpus()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+
+	// Keep the latest of the samples buffered by the driver per instance.
+	latest := make(map[uint32]nvml.VgpuInstanceUtilizationSample)
+	typ, samples, ret := d.dev.GetVgpuUtilization(0)
+	if ret == nvml.SUCCESS {
+		for _, s := range samples {
+			if s.TimeStamp >= latest[s.VgpuInstance].TimeStamp {
+				latest[s.VgpuInstance] = s
+			}
+		}
+	}
+
+	instances := make([]GPUVGPUInstance, 0, len(active))
+	for _, v := range active {
+		inst, err := vgpuInstance(v)
+		if err != nil {
+			return nil, err
+		}
+		if id, ok := vgpuInstanceID(v); ok {
+			if s, ok := latest[id]; ok {
+				inst.SMUtilization = decodeValue(typ, s.SmUtil, 1)
+				inst.MemoryUtilization = decodeValue(typ, s.MemUtil, 1)
+				inst.EncoderUtilization = decodeValue(typ, s.EncUtil, 1)
+				inst.DecoderUtilization = decodeValue(typ, s.DecUtil, 1)
+			}
+		}
+		instances = append(instances, *inst)
+	}
+	return instances, nil
+}
+
+// vgpuInstanceID returns the id NVML gives a vGPU instance in utilization
+// samples. go-nvml doesn't expose it, but its handles are the id itself.
+func vgpuInstanceID(v nvml.VgpuInstance) (uint32, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Uint32 {
+		return 0, false
+	}
+	return uint32(rv.Uint()), true
+}
+
+// vgpuInstance reads the identity, framebuffer usage and session stats of a
+// vGPU instance.
+func vgpuInstance(v nvml.VgpuInstance) (*GPUVGPUInstance, error) {
+	uuid, ret := v.GetUUID()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	fb, ret := v.GetFbUsage()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	inst := &GPUVGPUInstance{ID: uuid, FramebufferUsed: float64(fb)}
+	if t, ret := v.GetType(); ret == nvml.SUCCESS {
+		inst.Type, _ = t.GetName()
+	}
+	inst.VMID, _, _ = v.GetVmID()
+	if n, fps, latency, ret := v.GetEncoderStats(); ret == nvml.SUCCESS {
+		inst.Encoder = &GPUSessionStats{
+			Sessions:       float64(n),
+			AverageFPS:     float64(fps),
+			AverageLatency: float64(latency) / 1e6, // microseconds
+		}
+	}
+	if s, ret := v.GetFBCStats(); ret == nvml.SUCCESS {
+		inst.FBC = &GPUSessionStats{
+			Sessions:       float64(s.SessionsCount),
+			AverageFPS:     float64(s.AverageFPS),
+			AverageLatency: float64(s.AverageLatency) / 1e6, // microseconds
+		}
+	}
+	return inst, nil
+}
+
+// GetAccountingStats reads the accounting buffer of the device. NVML reports
+// it as not supported while accounting mode is off.
+func (d *realNVMLDevice) GetAccountingStats() ([]GPUAccountingStats, error) {
+	pids, ret := d.dev.GetAccountingPids()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	stats := make([]GPUAccountingStats, 0, len(pids))
+	for _, pid := range pids {
+		// NVML may have evicted the record since the PIDs were listed.
+		s, ret := d.dev.GetAccountingStats(uint32(pid))
+		if ret != nvml.SUCCESS {
+			log.Printf("GetAccountingStats() error for device %s, PID %d: %v", d.uuid, pid, nvmlError(ret))
+			continue
+		}
+		stats = append(stats, GPUAccountingStats{
+			PID:               uint(pid),
+			MaxMemoryUsage:    float64(s.MaxMemoryUsage),
+			GPUUtilization:    float64(s.GpuUtilization),
+			MemoryUtilization: float64(s.MemoryUtilization),
+			StartTime:         float64(s.StartTime) / 1e6, // microseconds
+			RunTime:           float64(s.Time) / 1e3,      // milliseconds
+			IsRunning:         s.IsRunning != 0,
+		})
+	}
+	return stats, nil
+}
+
+// GetFieldValues reads the fields ids of the device in a single call. Fields
+// the device doesn't report have a nil value.
+func (d *realNVMLDevice) GetFieldValues(ids []uint32) ([]GPUFieldValue, error) {
+	values := make([]nvml.FieldValue, len(ids))
+	for i, id := range ids {
+		values[i].FieldId = id
+	}
+	if err := nvmlError(d.dev.GetFieldValues(values)); err != nil {
+		return nil, err
+	}
+	fields := make([]GPUFieldValue, len(values))
+	for i, v := range values {
+		fields[i] = GPUFieldValue{ID: ids[i], Value: fieldValue(v, 1)}
+	}
+	return fields, nil
+}
+
+// GetEncoderSessions reports the encoder stats of the device and its
+// sessions. NVML reports latencies in microseconds.
+func (d *realNVMLDevice) GetEncoderSessions() (*GPUSessions, error) {
+	n, fps, latency, ret := d.dev.GetEncoderStats()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	s := &GPUSessions{Stats: GPUSessionStats{
+		Sessions:       float64(n),
+		AverageFPS:     float64(fps),
+		AverageLatency: float64(latency) / 1e6,
+	}}
+	infos, ret := d.dev.GetEncoderSessions()
+	if ret != nvml.SUCCESS {
+		return s, nil
+	}
+	for _, i := range infos {
+		s.Sessions = append(s.Sessions, GPUSession{
+			PID:            uint(i.Pid),
+			AverageFPS:     float64(i.AverageFps),
+			AverageLatency: float64(i.AverageLatency) / 1e6,
+		})
+	}
+	return s, nil
+}
+
+// GetFBCSessions reports the frame buffer capture stats of the device and its
+// sessions. NVML reports latencies in microseconds.
+func (d *realNVMLDevice) GetFBCSessions() (*GPUSessions, error) {
+	stats, ret := d.dev.GetFBCStats()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	s := &GPUSessions{Stats: GPUSessionStats{
+		Sessions:       float64(stats.SessionsCount),
+		AverageFPS:     float64(stats.AverageFPS),
+		AverageLatency: float64(stats.AverageLatency) / 1e6,
+	}}
+	infos, ret := d.dev.GetFBCSessions()
+	if ret != nvml.SUCCESS {
+		return s, nil
+	}
+	for _, i := range infos {
+		s.Sessions = append(s.Sessions, GPUSession{
+			PID:            uint(i.Pid),
+			AverageFPS:     float64(i.AverageFPS),
+			AverageLatency: float64(i.AverageLatency) / 1e6,
+		})
+	}
+	return s, nil
+}
+
+// computeModeNames maps NVML compute modes to the computeMode* values.
+var computeModeNames = map[nvml.ComputeMode]string{
+	nvml.COMPUTEMODE_DEFAULT:           computeModeDefault,
+	nvml.COMPUTEMODE_EXCLUSIVE_THREAD:  computeModeExclusiveThread,
+	nvml.COMPUTEMODE_PROHIBITED:        computeModeProhibited,
+	nvml.COMPUTEMODE_EXCLUSIVE_PROCESS: computeModeExclusiveProcess,
+}
+
+// GetDeviceMode reports compute, persistence, display and accounting mode.
+// Modes the device doesn't report are left empty or nil.
+func (d *realNVMLDevice) GetDeviceMode() (*GPUDeviceMode, error) {
+	mode := &GPUDeviceMode{}
+	if m, ret := d.dev.GetComputeMode(); ret == nvml.SUCCESS {
+		mode.ComputeMode = computeModeNames[m]
+	}
+	for _, m := range []struct {
+		dst **bool
+		get func() (nvml.EnableState, nvml.Return)
+	}{
+		{&mode.Persistence, d.dev.GetPersistenceMode},
+		{&mode.DisplayActive, d.dev.GetDisplayActive},
+		{&mode.DisplayMode, d.dev.GetDisplayMode},
+		{&mode.Accounting, d.dev.GetAccountingMode},
+	} {
+		if state, ret := m.get(); ret == nvml.SUCCESS {
+			enabled := state == nvml.FEATURE_ENABLED
+			*m.dst = &enabled
+		}
+	}
+	return mode, nil
+}
+
+// GetDeviceInfo reports the identity and CPU affinity of the device.
+func (d *realNVMLDevice) GetDeviceInfo() (*GPUDeviceInfo, error) {
+	info := &GPUDeviceInfo{
+		PCIBusID:    d.busID,
+		CPUAffinity: localCPUList(d.busID),
+		NUMANode:    numaNode(d.busID),
+	}
+	for _, v := range []struct {
+		dst *string
+		get func() (string, nvml.Return)
+	}{
+		{&info.Serial, d.dev.GetSerial},
+		{&info.VBIOSVersion, d.dev.GetVbiosVersion},
+		{&info.BoardPartNumber, d.dev.GetBoardPartNumber},
+		{&info.InfoROMImageVersion, d.dev.GetInforomImageVersion},
+		{&info.InfoROMOEMVersion, func() (string, nvml.Return) { return d.dev.GetInforomVersion(nvml.INFOROM_OEM) }},
+		{&info.InfoROMECCVersion, func() (string, nvml.Return) { return d.dev.GetInforomVersion(nvml.INFOROM_ECC) }},
+		{&info.InfoROMPowerVersion, func() (string, nvml.Return) { return d.dev.GetInforomVersion(nvml.INFOROM_POWER) }},
+	} {
+		if s, ret := v.get(); ret == nvml.SUCCESS {
+			*v.dst = s
+		}
+	}
+	if b, ret := d.dev.GetBrand(); ret == nvml.SUCCESS {
+		info.Brand = brandNames[b]
+	}
+	if a, ret := d.dev.GetArchitecture(); ret == nvml.SUCCESS {
+		info.Architecture = architectureNames[a]
+	}
+	if major, minor, ret := d.dev.GetCudaComputeCapability(); ret == nvml.SUCCESS {
+		info.CUDAComputeCapability = fmt.Sprintf("%d.%d", major, minor)
+	}
+	return info, nil
+}
+
+// brandNames maps NVML brands to the brand label of nvidia_gpu_info.
+var brandNames = map[nvml.BrandType]string{
+	nvml.BRAND_QUADRO:              "quadro",
+	nvml.BRAND_TESLA:               "tesla",
+	nvml.BRAND_NVS:                 "nvs",
+	nvml.BRAND_GRID:                "grid",
+	nvml.BRAND_GEFORCE:             "geforce",
+	nvml.BRAND_TITAN:               "titan",
+	nvml.BRAND_NVIDIA_VAPPS:        "nvidia_vapps",
+	nvml.BRAND_NVIDIA_VPC:          "nvidia_vpc",
+	nvml.BRAND_NVIDIA_VCS:          "nvidia_vcs",
+	nvml.BRAND_NVIDIA_VWS:          "nvidia_vws",
+	nvml.BRAND_NVIDIA_CLOUD_GAMING: "nvidia_cloud_gaming",
+	nvml.BRAND_QUADRO_RTX:          "quadro_rtx",
+	nvml.BRAND_NVIDIA_RTX:          "nvidia_rtx",
+	nvml.BRAND_NVIDIA:              "nvidia",
+	nvml.BRAND_GEFORCE_RTX:         "geforce_rtx",
+	nvml.BRAND_TITAN_RTX:           "titan_rtx",
+}
+
+// architectureNames maps NVML architectures to the architecture label of
+// nvidia_gpu_info.
+var architectureNames = map[nvml.DeviceArchitecture]string{
+	nvml.DEVICE_ARCH_KEPLER:  "kepler",
+	nvml.DEVICE_ARCH_MAXWELL: "maxwell",
+	nvml.DEVICE_ARCH_PASCAL:  "pascal",
+	nvml.DEVICE_ARCH_VOLTA:   "volta",
+	nvml.DEVICE_ARCH_TURING:  "turing",
+	nvml.DEVICE_ARCH_AMPERE:  "ampere",
+	nvml.DEVICE_ARCH_ADA:     "ada",
+	nvml.DEVICE_ARCH_HOPPER:  "hopper",
+}
+
+// numaNode reads the NUMA node of the PCI device busID from sysfs, or returns
+// nil if it can't be read or NUMA isn't enabled.
+func numaNode(busID string) *float64 {
+	if len(busID) < 4 {
+		return nil
+	}
+	b, err := os.ReadFile(fmt.Sprintf("/sys/bus/pci/devices/%s/numa_node", strings.ToLower(busID[4:])))
 	if err != nil {
+		return nil
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || node < 0 {
+		return nil
+	}
+	f := float64(node)
+	return &f
+}
+
+// localCPUList reads the CPUs local to the PCI device busID from sysfs, or
+// returns "" if they can't be read.
+func localCPUList(busID string) string {
+	if len(busID) < 4 {
+		return ""
+	}
+	// NVML reports an 8 digit PCI domain, sysfs uses 4.
+	b, err := os.ReadFile(fmt.Sprintf("/sys/bus/pci/devices/%s/local_cpulist", strings.ToLower(busID[4:])))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// GetTopology reports the closest common PCIe ancestor of the two devices and
+// the number of NVLinks between them.
+func (d *realNVMLDevice) GetTopology(peer NVMLDevice) (*GPUTopologyLink, error) {
+	p, ok := peer.(*realNVMLDevice)
+	if !ok {
+		return nil, errNotSupported
+	}
+	level, ret := d.dev.GetTopologyCommonAncestor(p.dev)
+	if err := nvmlError(ret); err != nil {
 		return nil, err
 	}
-	result := make([]GPUProcessUtilization, len(samples))
-	for i, s := range samples {
-		result[i] = GPUProcessUtilization{
-			PID:     s.PID,
-			DecUtil: s.DecUtil,
-			EncUtil: s.EncUtil,
-			MemUtil: s.MemUtil,
-			SmUtil:  s.SmUtil,
+	link := &GPUTopologyLink{}
+	switch level {
+	case nvml.TOPOLOGY_INTERNAL:
+		link.PCIe = topologySameBoard
+	case nvml.TOPOLOGY_SINGLE:
+		link.PCIe = topologySingleSwitch
+	case nvml.TOPOLOGY_MULTIPLE:
+		link.PCIe = topologyMultiSwitch
+	case nvml.TOPOLOGY_HOSTBRIDGE:
+		link.PCIe = topologyHostBridge
+	case nvml.TOPOLOGY_NODE:
+		link.PCIe = topologySameCPU
+	case nvml.TOPOLOGY_SYSTEM:
+		link.PCIe = topologyCrossCPU
+	default:
+		return nil, errNotSupported
+	}
+	// Devices without NVLink report every link as not supported, which
+	// just means there are no links.
+	for l := 0; l < nvml.NVLINK_MAX_LINKS; l++ {
+		if state, ret := d.dev.GetNvLinkState(l); ret != nvml.SUCCESS || state != nvml.FEATURE_ENABLED {
+			continue
+		}
+		if remote, ret := d.dev.GetNvLinkRemotePciInfo(l); ret == nvml.SUCCESS && cString(remote.BusId[:]) == p.busID {
+			link.NVLinks++
 		}
 	}
-	return result, nil
+	return link, nil
+}
+
+// --- Concrete XID event source ---
+
+type realXIDEventSource struct {
+	set nvml.EventSet
+}
+
+// NewXIDEventSource registers for critical XID events on all devices.
+// Devices that don't support XID events are skipped.
+func NewXIDEventSource(lib nvml.Interface) (XIDEventSource, error) {
+	n, ret := lib.DeviceGetCount()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	set, ret := lib.EventSetCreate()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		dev, ret := lib.DeviceGetHandleByIndex(i)
+		if ret == nvml.SUCCESS {
+			ret = dev.RegisterEvents(nvml.EventTypeXidCriticalError, set)
+		}
+		if ret != nvml.SUCCESS {
+			log.Printf("Couldn't register for XID events on device %d: %v", i, nvmlError(ret))
+		}
+	}
+	return &realXIDEventSource{set: set}, nil
+}
+
+func (s *realXIDEventSource) Wait(timeout time.Duration) (*XIDEvent, error) {
+	e, ret := s.set.Wait(uint32(timeout / time.Millisecond))
+	if ret == nvml.ERROR_TIMEOUT {
+		return nil, nil
+	}
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	if e.EventType != nvml.EventTypeXidCriticalError || e.Device == nil {
+		return nil, nil
+	}
+	uuid, ret := e.Device.GetUUID()
+	if err := nvmlError(ret); err != nil {
+		return nil, err
+	}
+	return &XIDEvent{UUID: uuid, XID: e.EventData}, nil
+}
+
+func (s *realXIDEventSource) Close() {
+	s.set.Free()
 }
 
 // --- Concrete process finder ---
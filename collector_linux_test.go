@@ -0,0 +1,765 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/NVIDIA/go-nvml/pkg/nvml/mock"
+)
+
+func TestNVMLError(t *testing.T) {
+	for _, tc := range []struct {
+		ret  nvml.Return
+		want error
+	}{
+		{nvml.ERROR_NOT_SUPPORTED, errNotSupported},
+		{nvml.ERROR_GPU_IS_LOST, errGPULost},
+		{nvml.ERROR_RESET_REQUIRED, errResetRequired},
+	} {
+		if err := nvmlError(tc.ret); !errors.Is(err, tc.want) {
+			t.Errorf("nvmlError(%d) = %v, want %v", tc.ret, err, tc.want)
+		}
+	}
+	if err := nvmlError(nvml.SUCCESS); err != nil {
+		t.Errorf("nvmlError(SUCCESS) = %v, want nil", err)
+	}
+	if err := nvmlError(nvml.ERROR_UNKNOWN); err == nil || classifyNVMLError(err) != healthNVMLError {
+		t.Errorf("nvmlError(ERROR_UNKNOWN) = %v, want an nvml_error", err)
+	}
+}
+
+func TestECCErrorCounts(t *testing.T) {
+	dev := &mock.Device{
+		GetMemoryErrorCounterFunc: func(typ nvml.MemoryErrorType, counter nvml.EccCounterType, loc nvml.MemoryLocation) (uint64, nvml.Return) {
+			// Only device memory and the register file have counters.
+			switch loc {
+			case nvml.MEMORY_LOCATION_DEVICE_MEMORY:
+				return uint64(10*int(typ) + 2*int(counter) + 1), nvml.SUCCESS
+			case nvml.MEMORY_LOCATION_REGISTER_FILE:
+				return 7, nvml.SUCCESS
+			}
+			return 0, nvml.ERROR_NOT_SUPPORTED
+		},
+	}
+	counts := eccErrorCounts(dev)
+	if len(counts) != 8 {
+		t.Fatalf("got %d counters, want 8: %+v", len(counts), counts)
+	}
+	for _, want := range []GPUECCErrorCount{
+		{eccSingleBit, eccVolatile, eccLocationDeviceMemory, 1},
+		{eccSingleBit, eccAggregate, eccLocationDeviceMemory, 3},
+		{eccDoubleBit, eccVolatile, eccLocationDeviceMemory, 11},
+		{eccDoubleBit, eccAggregate, eccLocationDeviceMemory, 13},
+		{eccDoubleBit, eccAggregate, eccLocationRegisterFile, 7},
+	} {
+		found := false
+		for _, c := range counts {
+			if c == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing counter %+v in %+v", want, counts)
+		}
+	}
+}
+
+func TestECCMode(t *testing.T) {
+	dev := &mock.Device{
+		GetEccModeFunc: func() (nvml.EnableState, nvml.EnableState, nvml.Return) {
+			return nvml.FEATURE_DISABLED, nvml.FEATURE_ENABLED, nvml.SUCCESS
+		},
+	}
+	if m := eccMode(dev); m == nil || m.Current || !m.Pending {
+		t.Errorf("eccMode() = %+v, want current disabled, pending enabled", m)
+	}
+	dev.GetEccModeFunc = func() (nvml.EnableState, nvml.EnableState, nvml.Return) {
+		return 0, 0, nvml.ERROR_NOT_SUPPORTED
+	}
+	if m := eccMode(dev); m != nil {
+		t.Errorf("eccMode() without ECC = %+v, want nil", m)
+	}
+}
+
+func TestPCIeStatus(t *testing.T) {
+	dev := &mock.Device{
+		GetPcieThroughputFunc: func(c nvml.PcieUtilCounter) (uint32, nvml.Return) {
+			if c == nvml.PCIE_UTIL_TX_BYTES {
+				return 1500, nvml.SUCCESS
+			}
+			return 0, nvml.ERROR_NOT_SUPPORTED
+		},
+		GetCurrPcieLinkGenerationFunc: func() (int, nvml.Return) { return 3, nvml.SUCCESS },
+		GetMaxPcieLinkGenerationFunc:  func() (int, nvml.Return) { return 4, nvml.SUCCESS },
+		GetCurrPcieLinkWidthFunc:      func() (int, nvml.Return) { return 8, nvml.SUCCESS },
+		GetMaxPcieLinkWidthFunc:       func() (int, nvml.Return) { return 16, nvml.SUCCESS },
+		GetPcieReplayCounterFunc:      func() (int, nvml.Return) { return 0, nvml.ERROR_NOT_SUPPORTED },
+	}
+	p := pcieStatus(dev)
+	if p == nil || p.TxBytesPerSecond == nil || *p.TxBytesPerSecond != 1.5e6 {
+		t.Fatalf("pcieStatus() = %+v, want tx of 1.5e6 bytes/s", p)
+	}
+	for _, f := range []struct {
+		name string
+		got  *float64
+		want float64
+	}{
+		{"link generation", p.LinkGeneration, 3},
+		{"max link generation", p.MaxLinkGeneration, 4},
+		{"link width", p.LinkWidth, 8},
+		{"max link width", p.MaxLinkWidth, 16},
+	} {
+		if f.got == nil || *f.got != f.want {
+			t.Errorf("%s = %v, want %v", f.name, f.got, f.want)
+		}
+	}
+	if p.RxBytesPerSecond != nil || p.ReplayCounter != nil {
+		t.Errorf("rx = %v, replays = %v, want nil", p.RxBytesPerSecond, p.ReplayCounter)
+	}
+}
+
+func TestPCIeStatus_NotSupported(t *testing.T) {
+	notSupported := func() (int, nvml.Return) { return 0, nvml.ERROR_NOT_SUPPORTED }
+	dev := &mock.Device{
+		GetPcieThroughputFunc: func(nvml.PcieUtilCounter) (uint32, nvml.Return) {
+			return 0, nvml.ERROR_NOT_SUPPORTED
+		},
+		GetCurrPcieLinkGenerationFunc: notSupported,
+		GetMaxPcieLinkGenerationFunc:  notSupported,
+		GetCurrPcieLinkWidthFunc:      notSupported,
+		GetMaxPcieLinkWidthFunc:       notSupported,
+		GetPcieReplayCounterFunc:      notSupported,
+	}
+	if p := pcieStatus(dev); p != nil {
+		t.Errorf("pcieStatus() = %+v, want nil", p)
+	}
+}
+
+func TestClocks(t *testing.T) {
+	dev := &mock.Device{
+		GetClockInfoFunc: func(c nvml.ClockType) (uint32, nvml.Return) {
+			return 1000 + uint32(c), nvml.SUCCESS
+		},
+		GetApplicationsClockFunc: func(c nvml.ClockType) (uint32, nvml.Return) {
+			if c != nvml.CLOCK_GRAPHICS && c != nvml.CLOCK_MEM {
+				return 0, nvml.ERROR_NOT_SUPPORTED
+			}
+			return 1500 + uint32(c), nvml.SUCCESS
+		},
+		GetMaxClockInfoFunc: func(c nvml.ClockType) (uint32, nvml.Return) {
+			if c == nvml.CLOCK_MEM {
+				return 0, nvml.ERROR_NOT_SUPPORTED
+			}
+			return 2000 + uint32(c), nvml.SUCCESS
+		},
+	}
+	want := []GPUClock{
+		{clockDomainGraphics, clockCurrent, 1000},
+		{clockDomainGraphics, clockApplication, 1500},
+		{clockDomainGraphics, clockMax, 2000},
+		{clockDomainSM, clockCurrent, 1001},
+		{clockDomainSM, clockMax, 2001},
+		{clockDomainMemory, clockCurrent, 1002},
+		{clockDomainMemory, clockApplication, 1502},
+		{clockDomainVideo, clockCurrent, 1003},
+		{clockDomainVideo, clockMax, 2003},
+	}
+	if got := clocks(dev); !reflect.DeepEqual(got, want) {
+		t.Errorf("clocks() = %+v, want %+v", got, want)
+	}
+}
+
+func TestThrottleReasons(t *testing.T) {
+	dev := &mock.Device{
+		GetCurrentClocksThrottleReasonsFunc: func() (uint64, nvml.Return) {
+			return nvml.ClocksThrottleReasonSwPowerCap | nvml.ClocksThrottleReasonSwThermalSlowdown, nvml.SUCCESS
+		},
+		GetViolationStatusFunc: func(p nvml.PerfPolicyType) (nvml.ViolationTime, nvml.Return) {
+			if p != nvml.PERF_POLICY_POWER {
+				return nvml.ViolationTime{}, nvml.ERROR_NOT_SUPPORTED
+			}
+			return nvml.ViolationTime{ViolationTime: 2500000000}, nvml.SUCCESS
+		},
+	}
+	want := &GPUClockEventReasons{
+		Active:    clockEventSwPowerCap | clockEventSwThermalSlowdown,
+		Durations: map[uint64]float64{clockEventSwPowerCap: 2.5},
+	}
+	if r := throttleReasons(dev); !reflect.DeepEqual(r, want) {
+		t.Errorf("throttleReasons() = %+v, want %+v", r, want)
+	}
+}
+
+func TestGetDeviceMode(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetComputeModeFunc: func() (nvml.ComputeMode, nvml.Return) {
+			return nvml.COMPUTEMODE_EXCLUSIVE_PROCESS, nvml.SUCCESS
+		},
+		GetPersistenceModeFunc: func() (nvml.EnableState, nvml.Return) {
+			return nvml.FEATURE_ENABLED, nvml.SUCCESS
+		},
+		// A display is connected but not initialized.
+		GetDisplayModeFunc: func() (nvml.EnableState, nvml.Return) {
+			return nvml.FEATURE_ENABLED, nvml.SUCCESS
+		},
+		GetDisplayActiveFunc: func() (nvml.EnableState, nvml.Return) {
+			return nvml.FEATURE_DISABLED, nvml.SUCCESS
+		},
+		GetAccountingModeFunc: func() (nvml.EnableState, nvml.Return) {
+			return 0, nvml.ERROR_NOT_SUPPORTED
+		},
+	}}
+	m, err := dev.GetDeviceMode()
+	if err != nil {
+		t.Fatalf("GetDeviceMode() error: %v", err)
+	}
+	if m.ComputeMode != computeModeExclusiveProcess {
+		t.Errorf("compute mode = %q, want %q", m.ComputeMode, computeModeExclusiveProcess)
+	}
+	if m.Persistence == nil || !*m.Persistence {
+		t.Errorf("persistence = %v, want enabled", m.Persistence)
+	}
+	if m.DisplayMode == nil || !*m.DisplayMode {
+		t.Errorf("display mode = %v, want enabled", m.DisplayMode)
+	}
+	if m.DisplayActive == nil || *m.DisplayActive {
+		t.Errorf("display active = %v, want disabled", m.DisplayActive)
+	}
+	if m.Accounting != nil {
+		t.Errorf("accounting = %v, want nil when not supported", *m.Accounting)
+	}
+}
+
+func TestGetAccountingStats(t *testing.T) {
+	dev := &realNVMLDevice{uuid: "gpu-0", dev: &mock.Device{
+		GetAccountingPidsFunc: func() ([]int, nvml.Return) {
+			return []int{100, 200}, nvml.SUCCESS
+		},
+		GetAccountingStatsFunc: func(pid uint32) (nvml.AccountingStats, nvml.Return) {
+			if pid == 200 {
+				// Evicted since the PIDs were listed.
+				return nvml.AccountingStats{}, nvml.ERROR_NOT_FOUND
+			}
+			return nvml.AccountingStats{
+				GpuUtilization:    40,
+				MemoryUtilization: 20,
+				MaxMemoryUsage:    1 << 30,
+				Time:              1500,             // milliseconds
+				StartTime:         1700000000000000, // microseconds
+				IsRunning:         1,
+			}, nvml.SUCCESS
+		},
+	}}
+	stats, err := dev.GetAccountingStats()
+	if err != nil {
+		t.Fatalf("GetAccountingStats() error: %v", err)
+	}
+	want := []GPUAccountingStats{{
+		PID:               100,
+		MaxMemoryUsage:    1 << 30,
+		GPUUtilization:    40,
+		MemoryUtilization: 20,
+		StartTime:         1700000000,
+		RunTime:           1.5,
+		IsRunning:         true,
+	}}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("GetAccountingStats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestGetAccountingStats_AccountingOff(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetAccountingPidsFunc: func() ([]int, nvml.Return) {
+			return nil, nvml.ERROR_NOT_SUPPORTED
+		},
+	}}
+	if _, err := dev.GetAccountingStats(); !errors.Is(err, errNotSupported) {
+		t.Errorf("GetAccountingStats() error = %v, want errNotSupported", err)
+	}
+}
+
+func TestProcesses(t *testing.T) {
+	pids, mems, err := processes([]nvml.ProcessInfo{
+		{Pid: 10, UsedGpuMemory: 1024},
+		{Pid: 20, UsedGpuMemory: valueNotAvailable},
+	}, nvml.SUCCESS)
+	if err != nil {
+		t.Fatalf("processes() error: %v", err)
+	}
+	if !reflect.DeepEqual(pids, []uint{10, 20}) || !reflect.DeepEqual(mems, []uint64{1024, 0}) {
+		t.Errorf("processes() = %v, %v, want [10 20], [1024 0]", pids, mems)
+	}
+}
+
+func TestGetNVLinks(t *testing.T) {
+	peer := &mock.Device{
+		GetUUIDFunc: func() (string, nvml.Return) { return "gpu-1", nvml.SUCCESS },
+	}
+	lib := &mock.Interface{
+		DeviceGetHandleByPciBusIdFunc: func(busID string) (nvml.Device, nvml.Return) {
+			if busID == "00000000:3B:00.0" {
+				return peer, nvml.SUCCESS
+			}
+			return nil, nvml.ERROR_NOT_FOUND
+		},
+	}
+	dev := &realNVMLDevice{lib: lib, dev: &mock.Device{
+		GetNvLinkStateFunc: func(link int) (nvml.EnableState, nvml.Return) {
+			switch link {
+			case 0:
+				return nvml.FEATURE_ENABLED, nvml.SUCCESS
+			case 1:
+				return nvml.FEATURE_DISABLED, nvml.SUCCESS
+			}
+			return 0, nvml.ERROR_INVALID_ARGUMENT
+		},
+		GetNvLinkRemotePciInfoFunc: func(link int) (nvml.PciInfo, nvml.Return) {
+			var pci nvml.PciInfo
+			for i, c := range "00000000:3B:00.0" {
+				pci.BusId[i] = int8(c)
+			}
+			return pci, nvml.SUCCESS
+		},
+		GetNvLinkErrorCounterFunc: func(link int, counter nvml.NvLinkErrorCounter) (uint64, nvml.Return) {
+			if counter == nvml.NVLINK_ERROR_DL_RECOVERY {
+				return 0, nvml.ERROR_NOT_SUPPORTED
+			}
+			return uint64(10*link) + uint64(counter), nvml.SUCCESS
+		},
+		GetFieldValuesFunc: func(values []nvml.FieldValue) nvml.Return {
+			for i := range values {
+				values[i].ValueType = uint32(nvml.VALUE_TYPE_UNSIGNED_LONG_LONG)
+				binary.NativeEndian.PutUint64(values[i].Value[:], uint64(values[i].FieldId)+uint64(values[i].ScopeId))
+			}
+			return nvml.SUCCESS
+		},
+	}}
+
+	links, err := dev.GetNVLinks()
+	if err != nil {
+		t.Fatalf("GetNVLinks() error: %v", err)
+	}
+	v := func(f float64) *float64 { return &f }
+	want := []GPUNVLink{
+		{
+			Link: 0, Active: true, RemoteBusID: "00000000:3B:00.0", RemoteUUID: "gpu-1",
+			RxBytes: v(nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_RX * 1024), TxBytes: v(nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_TX * 1024),
+			CRCFlitErrors: v(float64(nvml.NVLINK_ERROR_DL_CRC_FLIT)), CRCDataErrors: v(float64(nvml.NVLINK_ERROR_DL_CRC_DATA)),
+			ReplayErrors: v(float64(nvml.NVLINK_ERROR_DL_REPLAY)),
+		},
+		{
+			Link: 1, RxBytes: v((nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_RX + 1) * 1024), TxBytes: v((nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_TX + 1) * 1024),
+			CRCFlitErrors: v(float64(10 + nvml.NVLINK_ERROR_DL_CRC_FLIT)), CRCDataErrors: v(float64(10 + nvml.NVLINK_ERROR_DL_CRC_DATA)),
+			ReplayErrors: v(float64(10 + nvml.NVLINK_ERROR_DL_REPLAY)),
+		},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("GetNVLinks() = %+v, want %+v", links, want)
+	}
+}
+
+func TestGetNVLinks_NoLinks(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetNvLinkStateFunc: func(int) (nvml.EnableState, nvml.Return) {
+			return 0, nvml.ERROR_NOT_SUPPORTED
+		},
+	}}
+	if _, err := dev.GetNVLinks(); !errors.Is(err, errNotSupported) {
+		t.Errorf("GetNVLinks() error = %v, want errNotSupported", err)
+	}
+}
+
+func TestPowerLimits(t *testing.T) {
+	dev := &mock.Device{
+		GetPowerManagementLimitFunc:        func() (uint32, nvml.Return) { return 250000, nvml.SUCCESS },
+		GetEnforcedPowerLimitFunc:          func() (uint32, nvml.Return) { return 200000, nvml.SUCCESS },
+		GetPowerManagementDefaultLimitFunc: func() (uint32, nvml.Return) { return 300000, nvml.SUCCESS },
+		GetPowerManagementLimitConstraintsFunc: func() (uint32, uint32, nvml.Return) {
+			return 0, 0, nvml.ERROR_NOT_SUPPORTED
+		},
+	}
+	v := func(f float64) *float64 { return &f }
+	want := &GPUPowerLimits{ManagementLimit: v(250000), EnforcedLimit: v(200000), DefaultLimit: v(300000)}
+	if got := powerLimits(dev); !reflect.DeepEqual(got, want) {
+		t.Errorf("powerLimits() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetRetiredPages(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetRetiredPagesFunc: func(cause nvml.PageRetirementCause) ([]uint64, nvml.Return) {
+			if cause == nvml.PAGE_RETIREMENT_CAUSE_DOUBLE_BIT_ECC_ERROR {
+				return []uint64{0x1000}, nvml.SUCCESS
+			}
+			return []uint64{0x2000, 0x3000}, nvml.SUCCESS
+		},
+		GetRetiredPagesPendingStatusFunc: func() (nvml.EnableState, nvml.Return) {
+			return nvml.FEATURE_ENABLED, nvml.SUCCESS
+		},
+	}}
+	pages, err := dev.GetRetiredPages()
+	if err != nil {
+		t.Fatalf("GetRetiredPages() error: %v", err)
+	}
+	want := &GPURetiredPages{SingleBitECC: 2, DoubleBitECC: 1, Pending: true}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("GetRetiredPages() = %+v, want %+v", pages, want)
+	}
+}
+
+func TestGetRemappedRows(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetRemappedRowsFunc: func() (int, int, bool, bool, nvml.Return) {
+			return 3, 1, true, false, nvml.SUCCESS
+		},
+	}}
+	rows, err := dev.GetRemappedRows()
+	if err != nil {
+		t.Fatalf("GetRemappedRows() error: %v", err)
+	}
+	want := &GPURemappedRows{Correctable: 3, Uncorrectable: 1, Pending: true}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("GetRemappedRows() = %+v, want %+v", rows, want)
+	}
+}
+
+func TestGetMIGDevices(t *testing.T) {
+	mig := &mock.Device{
+		GetGpuInstanceIdFunc:     func() (int, nvml.Return) { return 1, nvml.SUCCESS },
+		GetComputeInstanceIdFunc: func() (int, nvml.Return) { return 0, nvml.SUCCESS },
+		GetUUIDFunc:              func() (string, nvml.Return) { return "MIG-0", nvml.SUCCESS },
+		GetMemoryInfoFunc: func() (nvml.Memory, nvml.Return) {
+			return nvml.Memory{Total: 5 << 30, Used: 1 << 30}, nvml.SUCCESS
+		},
+		GetNameFunc: func() (string, nvml.Return) { return "NVIDIA A100-SXM4-40GB MIG 1g.5gb", nvml.SUCCESS },
+		GetUtilizationRatesFunc: func() (nvml.Utilization, nvml.Return) {
+			return nvml.Utilization{}, nvml.ERROR_NOT_SUPPORTED
+		},
+		GetComputeRunningProcessesFunc: func() ([]nvml.ProcessInfo, nvml.Return) {
+			return []nvml.ProcessInfo{{Pid: 100, GpuInstanceId: 1}}, nvml.SUCCESS
+		},
+	}
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetMigModeFunc:           func() (int, int, nvml.Return) { return nvml.DEVICE_MIG_ENABLE, nvml.DEVICE_MIG_ENABLE, nvml.SUCCESS },
+		GetMaxMigDeviceCountFunc: func() (int, nvml.Return) { return 2, nvml.SUCCESS },
+		GetMigDeviceHandleByIndexFunc: func(i int) (nvml.Device, nvml.Return) {
+			if i == 0 {
+				return nil, nvml.ERROR_NOT_FOUND
+			}
+			return mig, nvml.SUCCESS
+		},
+	}}
+
+	devices, err := dev.GetMIGDevices()
+	if err != nil {
+		t.Fatalf("GetMIGDevices() error: %v", err)
+	}
+	want := []GPUMIGDevice{{
+		GPUInstanceID: 1,
+		Profile:       "1g.5gb",
+		UUID:          "MIG-0",
+		TotalMemory:   5 << 30,
+		UsedMemory:    1 << 30,
+		PIDs:          []uint{100},
+	}}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("GetMIGDevices() = %+v, want %+v", devices, want)
+	}
+}
+
+func TestGetMIGDevices_Disabled(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetMigModeFunc: func() (int, int, nvml.Return) { return nvml.DEVICE_MIG_DISABLE, nvml.DEVICE_MIG_ENABLE, nvml.SUCCESS },
+	}}
+	if _, err := dev.GetMIGDevices(); !errors.Is(err, errNotSupported) {
+		t.Errorf("GetMIGDevices() error = %v, want errNotSupported", err)
+	}
+}
+
+func TestGetDriverInfo(t *testing.T) {
+	client := &realNVMLClient{lib: &mock.Interface{
+		SystemGetDriverVersionFunc:     func() (string, nvml.Return) { return "535.104.05", nvml.SUCCESS },
+		SystemGetCudaDriverVersionFunc: func() (int, nvml.Return) { return 12020, nvml.SUCCESS },
+		SystemGetNVMLVersionFunc:       func() (string, nvml.Return) { return "12.535.104.05", nvml.SUCCESS },
+	}}
+	info, err := client.GetDriverInfo()
+	if err != nil {
+		t.Fatalf("GetDriverInfo() error: %v", err)
+	}
+	want := &GPUDriverInfo{DriverVersion: "535.104.05", CUDADriverVersion: "12.2", NVMLVersion: "12.535.104.05"}
+	if *info != *want {
+		t.Errorf("GetDriverInfo() = %+v, want %+v", info, want)
+	}
+}
+
+func TestGetDeviceInfo(t *testing.T) {
+	dev := &realNVMLDevice{busID: "00000000:3B:00.0", dev: &mock.Device{
+		GetSerialFunc:              func() (string, nvml.Return) { return "1324", nvml.SUCCESS },
+		GetVbiosVersionFunc:        func() (string, nvml.Return) { return "86.00.4D.00.04", nvml.SUCCESS },
+		GetBoardPartNumberFunc:     func() (string, nvml.Return) { return "", nvml.ERROR_NOT_SUPPORTED },
+		GetInforomImageVersionFunc: func() (string, nvml.Return) { return "G500.0200.00.03", nvml.SUCCESS },
+		GetInforomVersionFunc: func(object nvml.InforomObject) (string, nvml.Return) {
+			return [...]string{"oem", "ecc", "power"}[object], nvml.SUCCESS
+		},
+		GetBrandFunc:        func() (nvml.BrandType, nvml.Return) { return nvml.BRAND_TESLA, nvml.SUCCESS },
+		GetArchitectureFunc: func() (nvml.DeviceArchitecture, nvml.Return) { return nvml.DEVICE_ARCH_AMPERE, nvml.SUCCESS },
+		GetCudaComputeCapabilityFunc: func() (int, int, nvml.Return) {
+			return 8, 0, nvml.SUCCESS
+		},
+	}}
+	info, err := dev.GetDeviceInfo()
+	if err != nil {
+		t.Fatalf("GetDeviceInfo() error: %v", err)
+	}
+	want := []string{
+		"00000000:3B:00.0", "1324", "86.00.4D.00.04", "", "tesla", "ampere", "8.0",
+		"G500.0200.00.03", "oem", "ecc", "power",
+	}
+	if got := info.labelValues(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetDeviceInfo() labels = %q, want %q", got, want)
+	}
+}
+
+func TestMemoryInfo(t *testing.T) {
+	dev := &mock.Device{
+		GetMemoryInfo_v2Func: func() (nvml.Memory_v2, nvml.Return) {
+			return nvml.Memory_v2{Total: 16 << 30, Reserved: 1 << 28, Used: 1 << 30, Free: 15<<30 - 1<<28}, nvml.SUCCESS
+		},
+	}
+	used, free, reserved, err := memoryInfo(dev)
+	if err != nil {
+		t.Fatalf("memoryInfo() error: %v", err)
+	}
+	if used != 1<<30 || free != 15<<30-1<<28 || reserved == nil || *reserved != 1<<28 {
+		t.Errorf("memoryInfo() = %v, %v, %v, want %v, %v, %v", used, free, reserved, 1<<30, 15<<30-1<<28, 1<<28)
+	}
+}
+
+func TestMemoryInfo_V1Fallback(t *testing.T) {
+	dev := &mock.Device{
+		GetMemoryInfo_v2Func: func() (nvml.Memory_v2, nvml.Return) {
+			return nvml.Memory_v2{}, nvml.ERROR_FUNCTION_NOT_FOUND
+		},
+		GetMemoryInfoFunc: func() (nvml.Memory, nvml.Return) {
+			return nvml.Memory{Total: 16 << 30, Used: 1 << 30, Free: 15 << 30}, nvml.SUCCESS
+		},
+	}
+	used, free, reserved, err := memoryInfo(dev)
+	if err != nil {
+		t.Fatalf("memoryInfo() error: %v", err)
+	}
+	if used != 1<<30 || free != 15<<30 || reserved != nil {
+		t.Errorf("memoryInfo() = %v, %v, %v, want %v, %v, nil", used, free, reserved, 1<<30, 15<<30)
+	}
+}
+
+func TestTemperatureThresholds(t *testing.T) {
+	dev := &mock.Device{
+		GetTemperatureThresholdFunc: func(threshold nvml.TemperatureThresholds) (uint32, nvml.Return) {
+			switch threshold {
+			case nvml.TEMPERATURE_THRESHOLD_SHUTDOWN:
+				return 90, nvml.SUCCESS
+			case nvml.TEMPERATURE_THRESHOLD_SLOWDOWN:
+				return 87, nvml.SUCCESS
+			}
+			return 0, nvml.ERROR_NOT_SUPPORTED
+		},
+	}
+	v := func(f float64) *float64 { return &f }
+	want := &GPUTemperatureThresholds{Shutdown: v(90), Slowdown: v(87)}
+	if got := temperatureThresholds(dev); !reflect.DeepEqual(got, want) {
+		t.Errorf("temperatureThresholds() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMemoryTemperature(t *testing.T) {
+	dev := &mock.Device{
+		GetFieldValuesFunc: func(values []nvml.FieldValue) nvml.Return {
+			if values[0].FieldId != nvml.FI_DEV_MEMORY_TEMP {
+				t.Errorf("field id = %d, want %d", values[0].FieldId, nvml.FI_DEV_MEMORY_TEMP)
+			}
+			values[0].ValueType = uint32(nvml.VALUE_TYPE_UNSIGNED_INT)
+			binary.NativeEndian.PutUint32(values[0].Value[:], 45)
+			return nvml.SUCCESS
+		},
+	}
+	if got := memoryTemperature(dev); got == nil || *got != 45 {
+		t.Errorf("memoryTemperature() = %v, want 45", got)
+	}
+
+	// Devices without HBM report the field as not supported.
+	dev.GetFieldValuesFunc = func(values []nvml.FieldValue) nvml.Return {
+		values[0].NvmlReturn = uint32(nvml.ERROR_NOT_SUPPORTED)
+		return nvml.SUCCESS
+	}
+	if got := memoryTemperature(dev); got != nil {
+		t.Errorf("memoryTemperature() = %v, want nil", *got)
+	}
+}
+
+func TestFans(t *testing.T) {
+	dev := &mock.Device{
+		GetNumFansFunc:     func() (int, nvml.Return) { return 2, nvml.SUCCESS },
+		GetFanSpeed_v2Func: func(fan int) (uint32, nvml.Return) { return uint32(30 + 10*fan), nvml.SUCCESS },
+		GetTargetFanSpeedFunc: func(fan int) (int, nvml.Return) {
+			if fan == 1 {
+				return 0, nvml.ERROR_NOT_SUPPORTED
+			}
+			return 35, nvml.SUCCESS
+		},
+		GetFanControlPolicy_v2Func: func(fan int) (nvml.FanControlPolicy, nvml.Return) {
+			return nvml.FanControlPolicy(fan), nvml.SUCCESS
+		},
+	}
+	v := func(f float64) *float64 { return &f }
+	want := []GPUFan{
+		{Fan: 0, SpeedPercent: v(30), TargetSpeedPercent: v(35), ControlPolicy: fanControlPolicyAuto},
+		{Fan: 1, SpeedPercent: v(40), ControlPolicy: fanControlPolicyManual},
+	}
+	if got := fans(dev); !reflect.DeepEqual(got, want) {
+		t.Errorf("fans() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetVGPUInstances(t *testing.T) {
+	vgpu := &mock.VgpuInstance{
+		GetUUIDFunc:    func() (string, nvml.Return) { return "vgpu-0", nvml.SUCCESS },
+		GetFbUsageFunc: func() (uint64, nvml.Return) { return 1 << 30, nvml.SUCCESS },
+		GetTypeFunc: func() (nvml.VgpuTypeId, nvml.Return) {
+			return &mock.VgpuTypeId{
+				GetNameFunc: func() (string, nvml.Return) { return "GRID A100-4C", nvml.SUCCESS },
+			}, nvml.SUCCESS
+		},
+		GetVmIDFunc: func() (string, nvml.VgpuVmIdType, nvml.Return) {
+			return "vm-1", nvml.VGPU_VM_ID_UUID, nvml.SUCCESS
+		},
+		GetEncoderStatsFunc: func() (int, uint32, uint32, nvml.Return) { return 2, 30, 1500, nvml.SUCCESS },
+		GetFBCStatsFunc: func() (nvml.FBCStats, nvml.Return) {
+			return nvml.FBCStats{}, nvml.ERROR_NOT_SUPPORTED
+		},
+	}
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetVirtualizationModeFunc: func() (nvml.GpuVirtualizationMode, nvml.Return) {
+			return nvml.GPU_VIRTUALIZATION_MODE_HOST_VGPU, nvml.SUCCESS
+		},
+		GetActiveVgpusFunc: func() ([]nvml.VgpuInstance, nvml.Return) {
+			return []nvml.VgpuInstance{vgpu}, nvml.SUCCESS
+		},
+		GetVgpuUtilizationFunc: func(uint64) (nvml.ValueType, []nvml.VgpuInstanceUtilizationSample, nvml.Return) {
+			return nvml.VALUE_TYPE_UNSIGNED_INT, nil, nvml.SUCCESS
+		},
+	}}
+
+	instances, err := dev.GetVGPUInstances()
+	if err != nil {
+		t.Fatalf("GetVGPUInstances() error: %v", err)
+	}
+	want := []GPUVGPUInstance{{
+		ID:              "vgpu-0",
+		Type:            "GRID A100-4C",
+		VMID:            "vm-1",
+		FramebufferUsed: 1 << 30,
+		Encoder:         &GPUSessionStats{Sessions: 2, AverageFPS: 30, AverageLatency: 0.0015},
+	}}
+	if !reflect.DeepEqual(instances, want) {
+		t.Errorf("GetVGPUInstances() = %+v, want %+v", instances, want)
+	}
+}
+
+func TestGetVGPUInstances_NotHost(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetVirtualizationModeFunc: func() (nvml.GpuVirtualizationMode, nvml.Return) {
+			return nvml.GPU_VIRTUALIZATION_MODE_NONE, nvml.SUCCESS
+		},
+	}}
+	if _, err := dev.GetVGPUInstances(); !errors.Is(err, errNotSupported) {
+		t.Errorf("GetVGPUInstances() error = %v, want errNotSupported", err)
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	var v [8]byte
+	binary.NativeEndian.PutUint64(v[:], math.Float64bits(12.5))
+	if got := decodeValue(nvml.VALUE_TYPE_DOUBLE, v, 2); got == nil || *got != 25 {
+		t.Errorf("decodeValue(double) = %v, want 25", got)
+	}
+	binary.NativeEndian.PutUint32(v[:], uint32(0xffffffff))
+	if got := decodeValue(nvml.VALUE_TYPE_SIGNED_INT, v, 1); got == nil || *got != -1 {
+		t.Errorf("decodeValue(signed int) = %v, want -1", got)
+	}
+	if got := decodeValue(nvml.VALUE_TYPE_COUNT, v, 1); got != nil {
+		t.Errorf("decodeValue(unknown) = %v, want nil", *got)
+	}
+}
+
+func TestGetFieldValues(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetFieldValuesFunc: func(values []nvml.FieldValue) nvml.Return {
+			values[0].ValueType = uint32(nvml.VALUE_TYPE_UNSIGNED_LONG_LONG)
+			binary.NativeEndian.PutUint64(values[0].Value[:], 42)
+			values[1].NvmlReturn = uint32(nvml.ERROR_NOT_SUPPORTED)
+			return nvml.SUCCESS
+		},
+	}}
+	values, err := dev.GetFieldValues([]uint32{nvml.FI_DEV_PCIE_REPLAY_COUNTER, nvml.FI_DEV_MEMORY_TEMP})
+	if err != nil {
+		t.Fatalf("GetFieldValues() error: %v", err)
+	}
+	v := func(f float64) *float64 { return &f }
+	want := []GPUFieldValue{{ID: nvml.FI_DEV_PCIE_REPLAY_COUNTER, Value: v(42)}, {ID: nvml.FI_DEV_MEMORY_TEMP}}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("GetFieldValues() = %+v, want %+v", values, want)
+	}
+}
+
+func TestGetEncoderSessions(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetEncoderStatsFunc: func() (int, uint32, uint32, nvml.Return) { return 2, 45, 1500, nvml.SUCCESS },
+		GetEncoderSessionsFunc: func() ([]nvml.EncoderSessionInfo, nvml.Return) {
+			return []nvml.EncoderSessionInfo{
+				{Pid: 100, AverageFps: 30, AverageLatency: 1000},
+				{Pid: 200, AverageFps: 60, AverageLatency: 2000},
+			}, nvml.SUCCESS
+		},
+	}}
+	s, err := dev.GetEncoderSessions()
+	if err != nil {
+		t.Fatalf("GetEncoderSessions() error: %v", err)
+	}
+	want := &GPUSessions{
+		Stats: GPUSessionStats{Sessions: 2, AverageFPS: 45, AverageLatency: 0.0015},
+		Sessions: []GPUSession{
+			{PID: 100, AverageFPS: 30, AverageLatency: 0.001},
+			{PID: 200, AverageFPS: 60, AverageLatency: 0.002},
+		},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("GetEncoderSessions() = %+v, want %+v", s, want)
+	}
+}
+
+func TestGetFBCSessions(t *testing.T) {
+	dev := &realNVMLDevice{dev: &mock.Device{
+		GetFBCStatsFunc: func() (nvml.FBCStats, nvml.Return) {
+			return nvml.FBCStats{SessionsCount: 1, AverageFPS: 60, AverageLatency: 500}, nvml.SUCCESS
+		},
+		GetFBCSessionsFunc: func() ([]nvml.FBCSessionInfo, nvml.Return) {
+			return nil, nvml.ERROR_NOT_SUPPORTED
+		},
+	}}
+	s, err := dev.GetFBCSessions()
+	if err != nil {
+		t.Fatalf("GetFBCSessions() error: %v", err)
+	}
+	want := &GPUSessions{Stats: GPUSessionStats{Sessions: 1, AverageFPS: 60, AverageLatency: 0.0005}}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("GetFBCSessions() = %+v, want %+v", s, want)
+	}
+}
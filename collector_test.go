@@ -3,7 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -15,48 +19,198 @@ type mockNVMLClient struct {
 	deviceCount    uint
 	deviceCountErr error
 	devices        []mockNVMLDevice
+	driverInfo     *GPUDriverInfo
+	driverInfoErr  error
+	// newDeviceCalls counts NewDevice calls.
+	newDeviceCalls int
+	// openLatency simulates the time NVML takes to open a device and read
+	// its static attributes.
+	openLatency time.Duration
 }
 
 func (m *mockNVMLClient) GetDeviceCount() (uint, error) {
 	return m.deviceCount, m.deviceCountErr
 }
 
+func (m *mockNVMLClient) GetDeviceUUID(idx uint) (string, error) {
+	if int(idx) >= len(m.devices) {
+		return "", fmt.Errorf("device index %d out of range", idx)
+	}
+	if err := m.devices[idx].openErr; err != nil {
+		return "", err
+	}
+	return m.devices[idx].uuid, nil
+}
+
 func (m *mockNVMLClient) NewDevice(idx uint) (NVMLDevice, error) {
+	m.newDeviceCalls++
+	time.Sleep(m.openLatency)
 	if int(idx) >= len(m.devices) {
 		return nil, fmt.Errorf("device index %d out of range", idx)
 	}
+	if err := m.devices[idx].openErr; err != nil {
+		return nil, err
+	}
 	return &m.devices[idx], nil
 }
 
+func (m *mockNVMLClient) GetDriverInfo() (*GPUDriverInfo, error) {
+	return m.driverInfo, m.driverInfoErr
+}
+
 type mockNVMLDevice struct {
+	// openErr makes looking up and opening this device fail.
+	openErr     error
 	minor       string
 	uuid        string
 	model       string
 	totalMemory float64
 	status      *GPUDeviceStatus
 	statusErr   error
+	computePids []uint
+	computeMems []uint64
+	computeErr  error
+	mpsPids     []uint
+	mpsMems     []uint64
+	mpsErr      error
 	pids        []uint
 	mems        []uint64
 	procsErr    error
 	procUtil    []GPUProcessUtilization
 	procUtilErr error
+	lastSeen    []uint64
+	nvlinks     []GPUNVLink
+	nvlinksErr  error
+	retired     *GPURetiredPages
+	retiredErr  error
+	remapped    *GPURemappedRows
+	remappedErr error
+	migDevices  []GPUMIGDevice
+	migErr      error
+	mode        *GPUDeviceMode
+	modeErr     error
+	info        *GPUDeviceInfo
+	infoErr     error
+	// topology maps peer UUIDs to the link with that peer.
+	topology    map[string]*GPUTopologyLink
+	topologyErr error
+	// topologyCalls counts GetTopology calls.
+	topologyCalls int
+	vgpus         []GPUVGPUInstance
+	vgpusErr      error
+	accounting    []GPUAccountingStats
+	accountingErr error
+	// fieldValues maps field ids to values; ids missing from it are
+	// reported without a value.
+	fieldValues    map[uint32]float64
+	fieldValuesErr error
+	// fieldCalls records the ids of each GetFieldValues call.
+	fieldCalls [][]uint32
+	encoder    *GPUSessions
+	encoderErr error
+	fbc        *GPUSessions
+	fbcErr     error
 }
 
-func (d *mockNVMLDevice) GetMinor() string      { return d.minor }
-func (d *mockNVMLDevice) GetUUID() string       { return d.uuid }
-func (d *mockNVMLDevice) GetModel() string      { return d.model }
+func (d *mockNVMLDevice) GetMinor() string        { return d.minor }
+func (d *mockNVMLDevice) GetUUID() string         { return d.uuid }
+func (d *mockNVMLDevice) GetModel() string        { return d.model }
 func (d *mockNVMLDevice) GetTotalMemory() float64 { return d.totalMemory }
 
 func (d *mockNVMLDevice) Status() (*GPUDeviceStatus, error) {
 	return d.status, d.statusErr
 }
 
+func (d *mockNVMLDevice) GetComputeRunningProcesses() ([]uint, []uint64, error) {
+	return d.computePids, d.computeMems, d.computeErr
+}
+
+func (d *mockNVMLDevice) GetMPSComputeRunningProcesses() ([]uint, []uint64, error) {
+	return d.mpsPids, d.mpsMems, d.mpsErr
+}
+
 func (d *mockNVMLDevice) GetGraphicsRunningProcesses() ([]uint, []uint64, error) {
 	return d.pids, d.mems, d.procsErr
 }
 
-func (d *mockNVMLDevice) GetProcessUtilization() ([]GPUProcessUtilization, error) {
-	return d.procUtil, d.procUtilErr
+func (d *mockNVMLDevice) GetProcessUtilization(lastSeen uint64) ([]GPUProcessUtilization, error) {
+	d.lastSeen = append(d.lastSeen, lastSeen)
+	if d.procUtilErr != nil {
+		return nil, d.procUtilErr
+	}
+	var samples []GPUProcessUtilization
+	for _, s := range d.procUtil {
+		if lastSeen == 0 || s.TimeStamp > lastSeen {
+			samples = append(samples, s)
+		}
+	}
+	return samples, nil
+}
+
+func (d *mockNVMLDevice) GetNVLinks() ([]GPUNVLink, error) {
+	return d.nvlinks, d.nvlinksErr
+}
+
+func (d *mockNVMLDevice) GetRetiredPages() (*GPURetiredPages, error) {
+	return d.retired, d.retiredErr
+}
+
+func (d *mockNVMLDevice) GetRemappedRows() (*GPURemappedRows, error) {
+	return d.remapped, d.remappedErr
+}
+
+func (d *mockNVMLDevice) GetMIGDevices() ([]GPUMIGDevice, error) {
+	return d.migDevices, d.migErr
+}
+
+// GetVGPUInstances treats devices without vgpus as not being in vGPU host
+// mode; set vgpus to an empty slice for a host without instances.
+func (d *mockNVMLDevice) GetVGPUInstances() ([]GPUVGPUInstance, error) {
+	if d.vgpus == nil && d.vgpusErr == nil {
+		return nil, errNotSupported
+	}
+	return d.vgpus, d.vgpusErr
+}
+
+func (d *mockNVMLDevice) GetAccountingStats() ([]GPUAccountingStats, error) {
+	return d.accounting, d.accountingErr
+}
+
+func (d *mockNVMLDevice) GetFieldValues(ids []uint32) ([]GPUFieldValue, error) {
+	d.fieldCalls = append(d.fieldCalls, ids)
+	if d.fieldValuesErr != nil {
+		return nil, d.fieldValuesErr
+	}
+	values := make([]GPUFieldValue, 0, len(ids))
+	for _, id := range ids {
+		v := GPUFieldValue{ID: id}
+		if f, ok := d.fieldValues[id]; ok {
+			v.Value = &f
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (d *mockNVMLDevice) GetEncoderSessions() (*GPUSessions, error) {
+	return d.encoder, d.encoderErr
+}
+
+func (d *mockNVMLDevice) GetFBCSessions() (*GPUSessions, error) {
+	return d.fbc, d.fbcErr
+}
+
+func (d *mockNVMLDevice) GetDeviceMode() (*GPUDeviceMode, error) {
+	return d.mode, d.modeErr
+}
+
+func (d *mockNVMLDevice) GetDeviceInfo() (*GPUDeviceInfo, error) {
+	return d.info, d.infoErr
+}
+
+func (d *mockNVMLDevice) GetTopology(peer NVMLDevice) (*GPUTopologyLink, error) {
+	d.topologyCalls++
+	return d.topology[peer.GetUUID()], d.topologyErr
 }
 
 type mockProcessFinder struct {
@@ -99,6 +253,23 @@ func getMetricValue(m prometheus.Metric) float64 {
 	return metric.GetGauge().GetValue()
 }
 
+func getCounterValue(m prometheus.Metric) float64 {
+	var metric dto.Metric
+	m.Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+// findMetrics returns the metrics whose fully-qualified name is name.
+func findMetrics(metrics []prometheus.Metric, name string) []prometheus.Metric {
+	var result []prometheus.Metric
+	for _, m := range metrics {
+		if strings.Contains(m.Desc().String(), `fqName: "`+name+`"`) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
 func getMetricLabels(m prometheus.Metric) map[string]string {
 	var metric dto.Metric
 	m.Write(&metric)
@@ -124,10 +295,26 @@ func findMetricByName(metrics []prometheus.Metric, name string) []prometheus.Met
 	return nil
 }
 
+func float64Ptr(v float64) *float64 { return &v }
+
 func makeTestCollector(client NVMLClient, finder ProcessFinder) *Collector {
 	return newCollector(client, finder)
 }
 
+// newTestClient returns a client with n idle V100 devices, with minor numbers
+// 0 to n-1 and UUIDs gpu-0 to gpu-<n-1>.
+func newTestClient(n int) *mockNVMLClient {
+	client := &mockNVMLClient{deviceCount: uint(n)}
+	for i := 0; i < n; i++ {
+		client.devices = append(client.devices, mockNVMLDevice{
+			minor: fmt.Sprint(i), uuid: fmt.Sprintf("gpu-%d", i), model: "V100",
+			totalMemory: 16384,
+			status:      &GPUDeviceStatus{UsedMemory: 100, DutyCycle: 10, PowerUsage: 100, Temperature: 50, EncUtil: 5, DecUtil: 5},
+		})
+	}
+	return client
+}
+
 // --- parseContainerInfo tests ---
 
 func TestParseContainerInfo_ValidFormat(t *testing.T) {
@@ -260,9 +447,9 @@ func TestCollect_SingleDevice(t *testing.T) {
 
 	metrics := collectMetrics(c)
 
-	// 1 (numDevices) + 7 (device metrics) + 2*5 (process metrics) = 18
-	if len(metrics) != 18 {
-		t.Fatalf("expected 18 metrics, got %d", len(metrics))
+	// 1 (numDevices) + 7 (device metrics) + 2 (health) + 2*9 (process memory, mean and max utilization) = 28
+	if len(metrics) != 28 {
+		t.Fatalf("expected 28 metrics, got %d", len(metrics))
 	}
 
 	// Verify numDevices
@@ -291,9 +478,9 @@ func TestCollect_MultipleDevices(t *testing.T) {
 
 	metrics := collectMetrics(c)
 
-	// 1 (numDevices) + 7*2 (device metrics, no processes) = 15
-	if len(metrics) != 15 {
-		t.Fatalf("expected 15 metrics, got %d", len(metrics))
+	// 1 (numDevices) + (7 device + 2 health)*2 (no processes) = 19
+	if len(metrics) != 19 {
+		t.Fatalf("expected 19 metrics, got %d", len(metrics))
 	}
 }
 
@@ -312,11 +499,17 @@ func TestCollect_DeviceStatusError(t *testing.T) {
 
 	metrics := collectMetrics(c)
 
-	// numDevices + totalMemory (set before Status() call) + remaining device metrics with zero values
-	// from Collect(). totalMemory is set, then Status fails so other device metrics are skipped,
-	// but allMetrics still gets Collected.
-	if len(metrics) != 2 {
-		t.Fatalf("expected 2 metrics (numDevices + totalMemory), got %d", len(metrics))
+	// numDevices + totalMemory (set before Status() call) + up and healthy. totalMemory is set,
+	// then Status fails so other device metrics are skipped, but the device is reported down.
+	if len(metrics) != 4 {
+		t.Fatalf("expected 4 metrics (numDevices + totalMemory + up + healthy), got %d", len(metrics))
+	}
+	if up := findMetrics(metrics, "nvidia_gpu_up"); len(up) != 1 || getMetricValue(up[0]) != 0 {
+		t.Errorf("expected up = 0")
+	}
+	healthy := findMetrics(metrics, "nvidia_gpu_healthy")
+	if len(healthy) != 1 || getMetricValue(healthy[0]) != 0 || getMetricLabels(healthy[0])["reason"] != healthNVMLError {
+		t.Errorf("expected healthy{reason=%q} = 0", healthNVMLError)
 	}
 }
 
@@ -466,9 +659,9 @@ func TestCollect_GetGraphicsRunningProcessesError(t *testing.T) {
 
 	metrics := collectMetrics(c)
 
-	// numDevices + 7 device metrics = 8, no process metrics
-	if len(metrics) != 8 {
-		t.Fatalf("expected 8 metrics, got %d", len(metrics))
+	// numDevices + 7 device metrics + 2 health = 10, no process metrics
+	if len(metrics) != 10 {
+		t.Fatalf("expected 10 metrics, got %d", len(metrics))
 	}
 }
 
@@ -495,9 +688,9 @@ func TestCollect_GetProcessUtilizationError(t *testing.T) {
 
 	metrics := collectMetrics(c)
 
-	// numDevices + 7 device metrics + 1 process memory = 9, no utilization metrics
-	if len(metrics) != 9 {
-		t.Fatalf("expected 9 metrics, got %d", len(metrics))
+	// numDevices + 7 device metrics + 2 health + 1 process memory = 11, no utilization metrics
+	if len(metrics) != 11 {
+		t.Fatalf("expected 11 metrics, got %d", len(metrics))
 	}
 }
 
@@ -527,9 +720,9 @@ func TestCollect_ZeroPIDInUtilization(t *testing.T) {
 
 	metrics := collectMetrics(c)
 
-	// numDevices(1) + device(7) + process memory(1) + process util(4) = 13
-	if len(metrics) != 13 {
-		t.Fatalf("expected 13 metrics, got %d", len(metrics))
+	// numDevices(1) + device(7) + health(2) + process memory(1) + process util mean(4) + max(4) = 19
+	if len(metrics) != 19 {
+		t.Fatalf("expected 19 metrics, got %d", len(metrics))
 	}
 }
 
@@ -558,8 +751,1113 @@ func TestCollect_UtilizationPIDNotInRunningProcesses(t *testing.T) {
 
 	metrics := collectMetrics(c)
 
-	// numDevices(1) + device(7) + process memory(1) = 9, no util for PID 9999
-	if len(metrics) != 9 {
-		t.Fatalf("expected 9 metrics, got %d", len(metrics))
+	// numDevices(1) + device(7) + health(2) + process memory(1) = 11, no util for PID 9999
+	if len(metrics) != 11 {
+		t.Fatalf("expected 11 metrics, got %d", len(metrics))
+	}
+}
+
+func TestCollect_ECCErrors(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].status.ECCErrors = []GPUECCErrorCount{
+		{ErrorType: eccSingleBit, CounterType: eccAggregate, Location: eccLocationDeviceMemory, Count: 12},
+		{ErrorType: eccDoubleBit, CounterType: eccVolatile, Location: eccLocationRegisterFile, Count: 1},
+	}
+	client.devices[0].status.ECCMode = &GPUECCMode{Current: true, Pending: false}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + ecc counters(2) + ecc mode(2) = 14
+	if len(metrics) != 14 {
+		t.Fatalf("expected 14 metrics, got %d", len(metrics))
+	}
+
+	eccErrors := findMetrics(metrics, "nvidia_gpu_ecc_errors_total")
+	if len(eccErrors) != 2 {
+		t.Fatalf("expected 2 ecc counters, got %d", len(eccErrors))
+	}
+	for _, m := range eccErrors {
+		labels := getMetricLabels(m)
+		switch labels["location"] {
+		case eccLocationDeviceMemory:
+			if labels["error_type"] != eccSingleBit || labels["counter_type"] != eccAggregate {
+				t.Errorf("unexpected labels for device memory counter: %v", labels)
+			}
+			if v := getCounterValue(m); v != 12 {
+				t.Errorf("device memory ecc errors = %v, want 12", v)
+			}
+		case eccLocationRegisterFile:
+			if v := getCounterValue(m); v != 1 {
+				t.Errorf("register file ecc errors = %v, want 1", v)
+			}
+		default:
+			t.Errorf("unexpected location %q", labels["location"])
+		}
+	}
+
+	for _, m := range findMetrics(metrics, "nvidia_gpu_ecc_mode") {
+		labels := getMetricLabels(m)
+		want := map[string]float64{"current": 1, "pending": 0}[labels["state"]]
+		if v := getMetricValue(m); v != want {
+			t.Errorf("ecc_mode{state=%q} = %v, want %v", labels["state"], v, want)
+		}
+	}
+}
+
+func TestCollect_Clocks(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].status.Clocks = []GPUClock{
+		{Domain: clockDomainSM, Type: clockCurrent, MHz: 1380},
+		{Domain: clockDomainSM, Type: clockApplication, MHz: 1312},
+		{Domain: clockDomainMemory, Type: clockMax, MHz: 877},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	clocks := findMetrics(metrics, "nvidia_gpu_clock_hz")
+	if len(clocks) != 3 {
+		t.Fatalf("expected 3 clock metrics, got %d", len(clocks))
+	}
+	for _, m := range clocks {
+		labels := getMetricLabels(m)
+		if labels["domain"] == clockDomainSM && labels["type"] == clockApplication {
+			if v := getMetricValue(m); v != 1312e6 {
+				t.Errorf("sm application clock = %v, want 1312e6", v)
+			}
+		}
+	}
+}
+
+func TestCollect_ClockThrottleReasons(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].status.ClockEventReasons = &GPUClockEventReasons{
+		Active:    clockEventSwPowerCap | clockEventHwThermalSlowdown,
+		Durations: map[uint64]float64{clockEventSwPowerCap: 42.5},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	reasons := findMetrics(metrics, "nvidia_gpu_clock_throttle_reason")
+	if len(reasons) != len(clockEventReasons) {
+		t.Fatalf("expected %d throttle reasons, got %d", len(clockEventReasons), len(reasons))
+	}
+	active := map[string]bool{}
+	for _, m := range reasons {
+		if getMetricValue(m) == 1 {
+			active[getMetricLabels(m)["reason"]] = true
+		}
+	}
+	if len(active) != 2 || !active["sw_power_cap"] || !active["hw_thermal_slowdown"] {
+		t.Errorf("active reasons = %v, want sw_power_cap and hw_thermal_slowdown", active)
+	}
+
+	durations := findMetrics(metrics, "nvidia_gpu_clock_throttle_duration_seconds_total")
+	if len(durations) != 1 {
+		t.Fatalf("expected 1 throttle duration, got %d", len(durations))
+	}
+	if v := getCounterValue(durations[0]); v != 42.5 {
+		t.Errorf("sw_power_cap duration = %v, want 42.5", v)
+	}
+}
+
+func TestCollect_PCIe(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].status.PCIe = &GPUPCIeStatus{
+		TxBytesPerSecond:  float64Ptr(1e9),
+		RxBytesPerSecond:  float64Ptr(2e9),
+		LinkGeneration:    float64Ptr(3),
+		MaxLinkGeneration: float64Ptr(4),
+		LinkWidth:         float64Ptr(8),
+		MaxLinkWidth:      float64Ptr(16),
+		ReplayCounter:     float64Ptr(5),
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + throughput(2) + link generation(2) + link width(2) + replays(1) = 17
+	if len(metrics) != 17 {
+		t.Fatalf("expected 17 metrics, got %d", len(metrics))
+	}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_pcie_link_width") {
+		labels := getMetricLabels(m)
+		want := map[string]float64{"current": 8, "max": 16}[labels["type"]]
+		if v := getMetricValue(m); v != want {
+			t.Errorf("pcie_link_width{type=%q} = %v, want %v", labels["type"], v, want)
+		}
+	}
+	replays := findMetrics(metrics, "nvidia_gpu_pcie_replay_errors_total")
+	if len(replays) != 1 || getCounterValue(replays[0]) != 5 {
+		t.Errorf("expected pcie replay counter of 5, got %v", replays)
+	}
+}
+
+func TestCollect_PCIePartial(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].status.PCIe = &GPUPCIeStatus{TxBytesPerSecond: float64Ptr(1e9)}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// Fields the device doesn't report are left out rather than exported as 0.
+	if len(metrics) != 11 {
+		t.Fatalf("expected 11 metrics, got %d", len(metrics))
+	}
+}
+
+func TestCollect_NVLinks(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].nvlinks = []GPUNVLink{
+		{
+			Link: 0, Active: true, RemoteBusID: "00000000:07:00.0", RemoteUUID: "gpu-1",
+			RxBytes: float64Ptr(1024), TxBytes: float64Ptr(2048),
+			CRCFlitErrors: float64Ptr(3), ReplayErrors: float64Ptr(1),
+		},
+		{Link: 1, Active: false},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + link state(2) + rx/tx(2) + errors(2) = 16
+	if len(metrics) != 16 {
+		t.Fatalf("expected 16 metrics, got %d", len(metrics))
+	}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_nvlink_active") {
+		labels := getMetricLabels(m)
+		switch labels["link"] {
+		case "0":
+			if labels["remote_uuid"] != "gpu-1" || getMetricValue(m) != 1 {
+				t.Errorf("unexpected link 0 state: %v = %v", labels, getMetricValue(m))
+			}
+		case "1":
+			if getMetricValue(m) != 0 {
+				t.Errorf("link 1 should be inactive")
+			}
+		}
+	}
+	errs := findMetrics(metrics, "nvidia_gpu_nvlink_errors_total")
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 nvlink error counters, got %d", len(errs))
+	}
+}
+
+func TestCollect_NVLinksNotSupported(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].nvlinksErr = errNotSupported
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	if len(metrics) != 10 {
+		t.Fatalf("expected 10 metrics, got %d", len(metrics))
+	}
+}
+
+func TestCollect_EnergyFromNVML(t *testing.T) {
+	client := &mockNVMLClient{
+		deviceCount: 1,
+		devices: []mockNVMLDevice{
+			{
+				minor: "0", uuid: "gpu-0", model: "A100",
+				totalMemory: 40960,
+				status: &GPUDeviceStatus{
+					UsedMemory: 100, DutyCycle: 10, PowerUsage: 100000, Temperature: 50, EncUtil: 5, DecUtil: 5,
+					EnergyJoules: float64Ptr(123456),
+					PowerLimits: &GPUPowerLimits{
+						ManagementLimit: float64Ptr(400000),
+						EnforcedLimit:   float64Ptr(350000),
+						MinLimit:        float64Ptr(100000),
+					},
+				},
+			},
+		},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	energy := findMetrics(metrics, "nvidia_gpu_energy_consumption_joules_total")
+	if len(energy) != 1 {
+		t.Fatalf("expected 1 energy counter, got %d", len(energy))
+	}
+	if labels := getMetricLabels(energy[0]); labels["source"] != energySourceNVML {
+		t.Errorf("source = %q, want %q", labels["source"], energySourceNVML)
+	}
+	if v := getCounterValue(energy[0]); v != 123456 {
+		t.Errorf("energy = %v, want 123456", v)
+	}
+	if limits := findMetrics(metrics, "nvidia_gpu_power_limit_milliwatts"); len(limits) != 3 {
+		t.Errorf("expected 3 power limits, got %d", len(limits))
+	}
+}
+
+func TestCollect_EnergyIntegratedFromPower(t *testing.T) {
+	client := &mockNVMLClient{
+		deviceCount: 1,
+		devices: []mockNVMLDevice{
+			{
+				minor: "0", uuid: "gpu-0", model: "V100",
+				totalMemory: 16384,
+				status:      &GPUDeviceStatus{UsedMemory: 100, DutyCycle: 10, PowerUsage: 200000, Temperature: 50, EncUtil: 5, DecUtil: 5},
+			},
+		},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	// A single power sample isn't enough to estimate energy.
+	if energy := findMetrics(collectMetrics(c), "nvidia_gpu_energy_consumption_joules_total"); len(energy) != 0 {
+		t.Fatalf("expected no energy counter after the first sample, got %d", len(energy))
+	}
+
+	now = now.Add(15 * time.Second)
+	client.devices[0].status.PowerUsage = 300000
+	energy := findMetrics(collectMetrics(c), "nvidia_gpu_energy_consumption_joules_total")
+	if len(energy) != 1 {
+		t.Fatalf("expected 1 energy counter, got %d", len(energy))
+	}
+	if labels := getMetricLabels(energy[0]); labels["source"] != energySourceExporter {
+		t.Errorf("source = %q, want %q", labels["source"], energySourceExporter)
+	}
+	// (200 W + 300 W) / 2 * 15 s = 3750 J
+	if v := getCounterValue(energy[0]); v != 3750 {
+		t.Errorf("energy = %v, want 3750", v)
+	}
+}
+
+func TestCollect_RetiredPages(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].retired = &GPURetiredPages{SingleBitECC: 2, DoubleBitECC: 1, Pending: true}
+	client.devices[0].remappedErr = errNotSupported
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + retired pages(2) + pending(1) = 13
+	if len(metrics) != 13 {
+		t.Fatalf("expected 13 metrics, got %d", len(metrics))
+	}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_retired_pages") {
+		labels := getMetricLabels(m)
+		want := map[string]float64{"single_bit_ecc": 2, "double_bit_ecc": 1}[labels["cause"]]
+		if v := getMetricValue(m); v != want {
+			t.Errorf("retired_pages{cause=%q} = %v, want %v", labels["cause"], v, want)
+		}
+	}
+	pending := findMetrics(metrics, "nvidia_gpu_retired_pages_pending")
+	if len(pending) != 1 || getMetricValue(pending[0]) != 1 {
+		t.Error("expected retired_pages_pending = 1")
+	}
+}
+
+func TestCollect_RemappedRows(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].retiredErr = errNotSupported
+	client.devices[0].remapped = &GPURemappedRows{Correctable: 3, Uncorrectable: 1, Failure: true}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + remapped rows(2) + pending(1) + failure(1) = 14
+	if len(metrics) != 14 {
+		t.Fatalf("expected 14 metrics, got %d", len(metrics))
+	}
+	failure := findMetrics(metrics, "nvidia_gpu_remapped_rows_failure")
+	if len(failure) != 1 || getMetricValue(failure[0]) != 1 {
+		t.Error("expected remapped_rows_failure = 1")
+	}
+}
+
+func TestCollect_MIGInstances(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].migDevices = []GPUMIGDevice{
+		{GPUInstanceID: 1, ComputeInstanceID: 0, Profile: "3g.20gb", UUID: "MIG-a", TotalMemory: 20e9, UsedMemory: 5e9, Utilization: float64Ptr(60), PIDs: []uint{1001}},
+		{GPUInstanceID: 2, ComputeInstanceID: 0, Profile: "3g.20gb", UUID: "MIG-b", TotalMemory: 20e9, UsedMemory: 1e9},
+	}
+	client.devices[0].pids = []uint{1001, 1002}
+	client.devices[0].mems = []uint64{4096, 2048}
+	finder := &mockProcessFinder{
+		processes: map[int]*mockProcessInfo{
+			1001: {executable: "c@ns/pod-a"},
+			1002: {executable: "c@ns/pod-b"},
+		},
+	}
+	c := makeTestCollector(client, finder)
+
+	metrics := collectMetrics(c)
+
+	used := findMetrics(metrics, "nvidia_gpu_mig_memory_used_bytes")
+	if len(used) != 2 {
+		t.Fatalf("expected 2 MIG memory metrics, got %d", len(used))
+	}
+	for _, m := range used {
+		labels := getMetricLabels(m)
+		if labels["mig_profile"] != "3g.20gb" || labels["compute_instance_id"] != "0" {
+			t.Errorf("unexpected MIG labels %v", labels)
+		}
+	}
+	if util := findMetrics(metrics, "nvidia_gpu_mig_sm_utilization"); len(util) != 1 {
+		t.Errorf("expected 1 MIG utilization metric, got %d", len(util))
+	}
+
+	for _, m := range findMetrics(metrics, "nvidia_gpu_process_memory_used_bytes") {
+		labels := getMetricLabels(m)
+		want := map[string]string{"pod-a": "1", "pod-b": ""}[labels["pod_name"]]
+		if labels["gpu_instance_id"] != want {
+			t.Errorf("pod %s gpu_instance_id = %q, want %q", labels["pod_name"], labels["gpu_instance_id"], want)
+		}
+	}
+}
+
+func TestCollect_ComputeAndMPSProcesses(t *testing.T) {
+	client := &mockNVMLClient{
+		deviceCount: 1,
+		devices: []mockNVMLDevice{
+			{
+				minor: "0", uuid: "gpu-0", model: "V100",
+				totalMemory: 16384,
+				status:      &GPUDeviceStatus{UsedMemory: 100, DutyCycle: 10, PowerUsage: 100, Temperature: 50, EncUtil: 5, DecUtil: 5},
+				computePids: []uint{1001, 1002},
+				computeMems: []uint64{4096, 1024},
+				mpsPids:     []uint{1003},
+				mpsMems:     []uint64{512},
+				// 1002 uses both compute and graphics and must only be counted once.
+				pids: []uint{1002, 1004},
+				mems: []uint64{1024, 256},
+				procUtil: []GPUProcessUtilization{
+					{PID: 1001, SmUtil: 80},
+				},
+			},
+		},
+	}
+	finder := &mockProcessFinder{
+		processes: map[int]*mockProcessInfo{
+			1001: {executable: "trainer@ml/job-a"},
+			1002: {executable: "viz@ml/job-b"},
+			1003: {executable: "worker@ml/job-c"},
+			1004: {executable: "xorg@sys/display"},
+		},
+	}
+	c := makeTestCollector(client, finder)
+
+	metrics := collectMetrics(c)
+
+	used := findMetrics(metrics, "nvidia_gpu_process_memory_used_bytes")
+	if len(used) != 4 {
+		t.Fatalf("expected 4 process memory metrics, got %d", len(used))
+	}
+	wantType := map[string]string{
+		"job-a":   processTypeCompute,
+		"job-b":   processTypeCompute,
+		"job-c":   processTypeMPS,
+		"display": processTypeGraphics,
+	}
+	for _, m := range used {
+		labels := getMetricLabels(m)
+		if labels["type"] != wantType[labels["pod_name"]] {
+			t.Errorf("pod %s type = %q, want %q", labels["pod_name"], labels["type"], wantType[labels["pod_name"]])
+		}
+	}
+
+	sm := findMetrics(metrics, "nvidia_gpu_process_sm_utilization")
+	if len(sm) != 1 || getMetricLabels(sm[0])["pod_name"] != "job-a" {
+		t.Errorf("expected SM utilization for the compute process job-a")
+	}
+}
+
+func TestCollect_ProcessesWithSameLabelsAreSummed(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].computePids = []uint{1001, 1002}
+	client.devices[0].computeMems = []uint64{4096, 1024}
+	client.devices[0].procUtil = []GPUProcessUtilization{
+		{PID: 1001, SmUtil: 20, TimeStamp: 100},
+		{PID: 1002, SmUtil: 30, TimeStamp: 100},
+	}
+	finder := &mockProcessFinder{
+		processes: map[int]*mockProcessInfo{
+			1001: {executable: "worker@ml/job-a"},
+			1002: {executable: "worker@ml/job-a"},
+		},
+	}
+	c := makeTestCollector(client, finder)
+
+	metrics := collectMetrics(c)
+
+	for name, want := range map[string]float64{
+		"nvidia_gpu_process_memory_used_bytes":  5120,
+		"nvidia_gpu_process_sm_utilization":     50,
+		"nvidia_gpu_process_sm_utilization_max": 50,
+	} {
+		m := findMetrics(metrics, name)
+		if len(m) != 1 {
+			t.Fatalf("expected 1 %s metric, got %d", name, len(m))
+		}
+		if v := getMetricValue(m[0]); v != want {
+			t.Errorf("%s = %v, want %v", name, v, want)
+		}
+	}
+}
+
+func TestCollect_ProcessListErrorsAreIndependent(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].computePids = []uint{1001}
+	client.devices[0].computeMems = []uint64{4096}
+	client.devices[0].mpsErr = errNotSupported
+	client.devices[0].procsErr = errors.New("rpc error")
+	finder := &mockProcessFinder{
+		processes: map[int]*mockProcessInfo{
+			1001: {executable: "c@ns/pod"},
+		},
+	}
+	c := makeTestCollector(client, finder)
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + compute process memory(1) = 11
+	if len(metrics) != 11 {
+		t.Fatalf("expected 11 metrics, got %d", len(metrics))
+	}
+}
+
+func TestCollect_ProcessUtilizationWindow(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].pids = []uint{1001}
+	client.devices[0].mems = []uint64{50}
+	client.devices[0].procUtil = []GPUProcessUtilization{
+		{PID: 1001, SmUtil: 10, MemUtil: 4, TimeStamp: 100},
+		{PID: 1001, SmUtil: 30, MemUtil: 8, TimeStamp: 200},
+		{PID: 0, SmUtil: 99, TimeStamp: 250},
+	}
+	finder := &mockProcessFinder{
+		processes: map[int]*mockProcessInfo{
+			1001: {executable: "c@ns/pod"},
+		},
+	}
+	c := makeTestCollector(client, finder)
+
+	metrics := collectMetrics(c)
+
+	for name, want := range map[string]float64{
+		"nvidia_gpu_process_sm_utilization":         20,
+		"nvidia_gpu_process_sm_utilization_max":     30,
+		"nvidia_gpu_process_memory_utilization":     6,
+		"nvidia_gpu_process_memory_utilization_max": 8,
+	} {
+		m := findMetrics(metrics, name)
+		if len(m) != 1 {
+			t.Fatalf("expected 1 %s metric, got %d", name, len(m))
+		}
+		if v := getMetricValue(m[0]); v != want {
+			t.Errorf("%s = %v, want %v", name, v, want)
+		}
+	}
+
+	// The next scrape only consumes samples newer than the last one seen,
+	// including the sample for PID 0.
+	dev := &client.devices[0]
+	dev.procUtil = append(dev.procUtil, GPUProcessUtilization{PID: 1001, SmUtil: 90, MemUtil: 2, TimeStamp: 300})
+	metrics = collectMetrics(c)
+
+	if got := dev.lastSeen; len(got) != 2 || got[0] != 0 || got[1] != 250 {
+		t.Errorf("lastSeen passed to GetProcessUtilization = %v, want [0 250]", got)
+	}
+	sm := findMetrics(metrics, "nvidia_gpu_process_sm_utilization")
+	if len(sm) != 1 || getMetricValue(sm[0]) != 90 {
+		t.Errorf("expected mean SM utilization of 90 over the second window")
+	}
+
+	// Without new samples the process has no utilization for the window.
+	metrics = collectMetrics(c)
+	if sm := findMetrics(metrics, "nvidia_gpu_process_sm_utilization"); len(sm) != 0 {
+		t.Errorf("expected no SM utilization without new samples, got %d", len(sm))
+	}
+}
+
+func TestCollect_DeviceMode(t *testing.T) {
+	enabled, disabled := true, false
+	client := newTestClient(1)
+	client.devices[0].mode = &GPUDeviceMode{
+		ComputeMode:   computeModeExclusiveProcess,
+		Persistence:   &enabled,
+		DisplayActive: &disabled,
+		Accounting:    &enabled,
+	}
+	client.devices[0].status.PerformanceState = float64Ptr(2)
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + pstate(1) + compute modes(4) + persistence, display active, accounting(3) = 18
+	if len(metrics) != 18 {
+		t.Fatalf("expected 18 metrics, got %d", len(metrics))
+	}
+	if m := findMetrics(metrics, "nvidia_gpu_performance_state"); len(m) != 1 || getMetricValue(m[0]) != 2 {
+		t.Error("expected performance_state = 2")
+	}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_compute_mode") {
+		mode := getMetricLabels(m)["mode"]
+		want := boolToFloat(mode == computeModeExclusiveProcess)
+		if v := getMetricValue(m); v != want {
+			t.Errorf("compute_mode{mode=%q} = %v, want %v", mode, v, want)
+		}
+	}
+	if m := findMetrics(metrics, "nvidia_gpu_display_mode"); len(m) != 0 {
+		t.Error("expected no display_mode when the device doesn't report it")
+	}
+}
+
+func TestUpdateDriverInfo(t *testing.T) {
+	client := &mockNVMLClient{
+		driverInfo: &GPUDriverInfo{DriverVersion: "535.104.05", CUDADriverVersion: "12.2", NVMLVersion: "12.535.104.05"},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+	c.UpdateDriverInfo()
+
+	// A reinitialised NVML may come with a new driver; only the new
+	// versions must be exported.
+	client.driverInfo = &GPUDriverInfo{DriverVersion: "550.54.15", CUDADriverVersion: "12.4", NVMLVersion: "12.550.54.15"}
+	c.UpdateDriverInfo()
+
+	info := findMetrics(collectMetrics(c), "nvidia_gpu_driver_info")
+	if len(info) != 1 {
+		t.Fatalf("expected 1 driver_info metric, got %d", len(info))
+	}
+	labels := getMetricLabels(info[0])
+	if labels["driver_version"] != "550.54.15" || labels["cuda_driver_version"] != "12.4" || labels["nvml_version"] != "12.550.54.15" {
+		t.Errorf("unexpected driver_info labels %v", labels)
+	}
+	if v := getMetricValue(info[0]); v != 1 {
+		t.Errorf("driver_info = %v, want 1", v)
+	}
+}
+
+func TestUpdateDriverInfo_ErrorKeepsPreviousInfo(t *testing.T) {
+	client := &mockNVMLClient{
+		driverInfo: &GPUDriverInfo{DriverVersion: "535.104.05"},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+	c.UpdateDriverInfo()
+
+	client.driverInfoErr = errors.New("nvml: Uninitialized")
+	c.UpdateDriverInfo()
+
+	info := findMetrics(collectMetrics(c), "nvidia_gpu_driver_info")
+	if len(info) != 1 || getMetricLabels(info[0])["driver_version"] != "535.104.05" {
+		t.Error("expected driver_info to keep the previous driver version")
+	}
+}
+
+func TestCollect_DeviceInfo(t *testing.T) {
+	client := &mockNVMLClient{
+		deviceCount: 1,
+		devices: []mockNVMLDevice{
+			{
+				minor: "0", uuid: "gpu-0", model: "A100",
+				totalMemory: 40960,
+				statusErr:   errors.New("status error"),
+				info: &GPUDeviceInfo{
+					PCIBusID:              "00000000:07:00.0",
+					Serial:                "1324020012345",
+					VBIOSVersion:          "92.00.25.00.08",
+					Architecture:          "ampere",
+					CUDAComputeCapability: "8.0",
+				},
+			},
+		},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// The identity is static, so it is exported even if Status() fails.
+	info := findMetrics(metrics, "nvidia_gpu_info")
+	if len(info) != 1 {
+		t.Fatalf("expected 1 info metric, got %d", len(info))
+	}
+	labels := getMetricLabels(info[0])
+	for k, want := range map[string]string{
+		"uuid":                    "gpu-0",
+		"pci_bus_id":              "00000000:07:00.0",
+		"serial":                  "1324020012345",
+		"vbios_version":           "92.00.25.00.08",
+		"architecture":            "ampere",
+		"cuda_compute_capability": "8.0",
+		"brand":                   "",
+	} {
+		if labels[k] != want {
+			t.Errorf("info label %s = %q, want %q", k, labels[k], want)
+		}
+	}
+}
+
+func TestCollect_MemoryAccounting(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].status.FreeMemory = float64Ptr(40000)
+	client.devices[0].status.ReservedMemory = float64Ptr(860)
+	client.devices[0].status.BAR1 = &GPUBAR1Memory{Total: 65536, Used: 1024, Free: 64512}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + free/reserved(2) + bar1(3)
+	if len(metrics) != 15 {
+		t.Fatalf("expected 15 metrics, got %d", len(metrics))
+	}
+	want := map[string]float64{
+		"nvidia_gpu_memory_free_bytes":       40000,
+		"nvidia_gpu_memory_reserved_bytes":   860,
+		"nvidia_gpu_bar1_memory_total_bytes": 65536,
+		"nvidia_gpu_bar1_memory_used_bytes":  1024,
+		"nvidia_gpu_bar1_memory_free_bytes":  64512,
+	}
+	for name, v := range want {
+		found := findMetrics(metrics, name)
+		if len(found) != 1 {
+			t.Errorf("expected 1 %s, got %d", name, len(found))
+			continue
+		}
+		if got := getMetricValue(found[0]); got != v {
+			t.Errorf("%s = %v, want %v", name, got, v)
+		}
+	}
+}
+
+func TestCollect_Thermal(t *testing.T) {
+	client := &mockNVMLClient{
+		deviceCount: 1,
+		devices: []mockNVMLDevice{
+			{
+				minor: "0", uuid: "gpu-0", model: "H100",
+				totalMemory: 81920,
+				status: &GPUDeviceStatus{
+					UsedMemory: 100, DutyCycle: 10, PowerUsage: 100, Temperature: 62, EncUtil: 5, DecUtil: 5,
+					MemoryTemperature: float64Ptr(70),
+					TemperatureThresholds: &GPUTemperatureThresholds{
+						Shutdown:  float64Ptr(92),
+						Slowdown:  float64Ptr(89),
+						MemoryMax: float64Ptr(95),
+					},
+				},
+			},
+		},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + memory temperature(1) + thresholds(3) + headroom(1)
+	if len(metrics) != 15 {
+		t.Fatalf("expected 15 metrics, got %d", len(metrics))
+	}
+	if mem := findMetrics(metrics, "nvidia_gpu_memory_temperature_celsius"); len(mem) != 1 || getMetricValue(mem[0]) != 70 {
+		t.Errorf("expected memory_temperature_celsius = 70")
+	}
+	want := map[string]float64{thresholdShutdown: 92, thresholdSlowdown: 89, thresholdMemoryMax: 95}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_temperature_threshold_celsius") {
+		threshold := getMetricLabels(m)["threshold"]
+		if v := getMetricValue(m); v != want[threshold] {
+			t.Errorf("temperature_threshold_celsius{threshold=%q} = %v, want %v", threshold, v, want[threshold])
+		}
+	}
+	if headroom := findMetrics(metrics, "nvidia_gpu_temperature_slowdown_headroom_celsius"); len(headroom) != 1 || getMetricValue(headroom[0]) != 27 {
+		t.Errorf("expected temperature_slowdown_headroom_celsius = 27")
+	}
+}
+
+func TestCollect_Fans(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].status.Fans = []GPUFan{
+		{Fan: 0, SpeedPercent: float64Ptr(45), TargetSpeedPercent: float64Ptr(50), ControlPolicy: fanControlPolicyAuto},
+		{Fan: 1, SpeedPercent: float64Ptr(0)},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + fan 0 (speed, target, 2 policies) + fan 1 (speed)
+	if len(metrics) != 15 {
+		t.Fatalf("expected 15 metrics, got %d", len(metrics))
+	}
+	speeds := map[string]float64{}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_fan_speed_percent") {
+		speeds[getMetricLabels(m)["fan"]] = getMetricValue(m)
+	}
+	if speeds["0"] != 45 || speeds["1"] != 0 || len(speeds) != 2 {
+		t.Errorf("unexpected fan speeds %v", speeds)
+	}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_fan_control_policy") {
+		labels := getMetricLabels(m)
+		want := boolToFloat(labels["policy"] == fanControlPolicyAuto)
+		if labels["fan"] != "0" || getMetricValue(m) != want {
+			t.Errorf("fan_control_policy%v = %v, want %v", labels, getMetricValue(m), want)
+		}
+	}
+}
+
+func TestCollect_Topology(t *testing.T) {
+	status := func() *GPUDeviceStatus {
+		return &GPUDeviceStatus{UsedMemory: 100, DutyCycle: 10, PowerUsage: 100, Temperature: 50, EncUtil: 5, DecUtil: 5}
+	}
+	client := &mockNVMLClient{
+		deviceCount: 3,
+		devices: []mockNVMLDevice{
+			{
+				minor: "0", uuid: "gpu-0", model: "A100", totalMemory: 40960, status: status(),
+				info: &GPUDeviceInfo{NUMANode: float64Ptr(0), CPUAffinity: "0-23,48-71"},
+				topology: map[string]*GPUTopologyLink{
+					"gpu-1": {PCIe: topologySingleSwitch, NVLinks: 12},
+					"gpu-2": {PCIe: topologyCrossCPU},
+				},
+			},
+			{
+				minor: "1", uuid: "gpu-1", model: "A100", totalMemory: 40960, status: status(),
+				topology: map[string]*GPUTopologyLink{
+					"gpu-0": {PCIe: topologySingleSwitch, NVLinks: 12},
+				},
+			},
+			{
+				minor: "2", uuid: "gpu-2", model: "A100", totalMemory: 40960, status: status(),
+				topologyErr: errNotSupported,
+			},
+		},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	links := map[[2]string]map[string]string{}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_topology_info") {
+		labels := getMetricLabels(m)
+		links[[2]string{labels["uuid"], labels["peer_uuid"]}] = labels
+	}
+	if len(links) != 3 {
+		t.Fatalf("expected 3 topology links, got %d: %v", len(links), links)
+	}
+	if l := links[[2]string{"gpu-0", "gpu-1"}]; l["level"] != topologyNVLink || l["pcie"] != topologySingleSwitch || l["nvlinks"] != "12" {
+		t.Errorf("unexpected gpu-0 -> gpu-1 link %v", l)
+	}
+	if l := links[[2]string{"gpu-0", "gpu-2"}]; l["level"] != topologyCrossCPU || l["nvlinks"] != "0" {
+		t.Errorf("unexpected gpu-0 -> gpu-2 link %v", l)
+	}
+
+	if numa := findMetrics(metrics, "nvidia_gpu_numa_node"); len(numa) != 1 || getMetricValue(numa[0]) != 0 {
+		t.Errorf("expected numa_node = 0 for gpu-0 only")
+	}
+	affinity := findMetrics(metrics, "nvidia_gpu_cpu_affinity_info")
+	if len(affinity) != 1 || getMetricLabels(affinity[0])["cpus"] != "0-23,48-71" {
+		t.Errorf("expected cpu_affinity_info{cpus=\"0-23,48-71\"} for gpu-0")
+	}
+
+	// Links are cached, so a second scrape only retries the unsupported pairs.
+	collectMetrics(c)
+	if calls := client.devices[0].topologyCalls; calls != 2 {
+		t.Errorf("expected 2 GetTopology calls on gpu-0, got %d", calls)
+	}
+	if calls := client.devices[2].topologyCalls; calls != 4 {
+		t.Errorf("expected 4 GetTopology calls on gpu-2, got %d", calls)
+	}
+}
+
+func TestCollect_VGPUs(t *testing.T) {
+	client := newTestClient(2)
+	client.devices[0].vgpus = []GPUVGPUInstance{
+		{
+			ID: "3251634213", Type: "GRID A100-4C", VMID: "vm-a",
+			FramebufferUsed: 1 << 30,
+			SMUtilization:   float64Ptr(80),
+			Encoder:         &GPUSessionStats{Sessions: 2, AverageFPS: 30, AverageLatency: 0.004},
+		},
+		{ID: "3251634214", Type: "GRID A100-4C", VMID: "vm-b"},
+	}
+	client.devices[1].vgpus = []GPUVGPUInstance{}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	counts := map[string]float64{}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_vgpu_instances") {
+		counts[getMetricLabels(m)["uuid"]] = getMetricValue(m)
+	}
+	if counts["gpu-0"] != 2 || counts["gpu-1"] != 0 || len(counts) != 2 {
+		t.Errorf("unexpected vgpu_instances %v", counts)
+	}
+
+	fb := findMetrics(metrics, "nvidia_gpu_vgpu_framebuffer_used_bytes")
+	if len(fb) != 2 {
+		t.Fatalf("expected 2 vgpu_framebuffer_used_bytes, got %d", len(fb))
+	}
+	for _, m := range fb {
+		labels := getMetricLabels(m)
+		if labels["vgpu_type"] != "GRID A100-4C" || labels["uuid"] != "gpu-0" {
+			t.Errorf("unexpected vGPU labels %v", labels)
+		}
+	}
+
+	sm := findMetrics(metrics, "nvidia_gpu_vgpu_sm_utilization")
+	if len(sm) != 1 || getMetricValue(sm[0]) != 80 || getMetricLabels(sm[0])["vm_id"] != "vm-a" {
+		t.Errorf("expected vgpu_sm_utilization = 80 for vm-a only")
+	}
+	if enc := findMetrics(metrics, "nvidia_gpu_vgpu_encoder_sessions"); len(enc) != 1 || getMetricValue(enc[0]) != 2 {
+		t.Errorf("expected vgpu_encoder_sessions = 2 for vm-a only")
+	}
+	if lat := findMetrics(metrics, "nvidia_gpu_vgpu_encoder_average_latency_seconds"); len(lat) != 1 || getMetricValue(lat[0]) != 0.004 {
+		t.Errorf("expected vgpu_encoder_average_latency_seconds = 0.004")
+	}
+	if fbc := findMetrics(metrics, "nvidia_gpu_vgpu_fbc_sessions"); len(fbc) != 0 {
+		t.Errorf("expected no vgpu_fbc_sessions, got %d", len(fbc))
+	}
+}
+
+func TestCollect_AccountingAttributesExitedProcesses(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].pids = []uint{1001}
+	client.devices[0].mems = []uint64{4096}
+	client.devices[0].accounting = []GPUAccountingStats{
+		{PID: 1001, MaxMemoryUsage: 8192, GPUUtilization: 40, MemoryUtilization: 20, StartTime: 1700000000, RunTime: 30, IsRunning: true},
+		{PID: 1002, MaxMemoryUsage: 1024, GPUUtilization: 90, MemoryUtilization: 10, StartTime: 1699990000, RunTime: 600},
+	}
+	finder := &mockProcessFinder{
+		processes: map[int]*mockProcessInfo{
+			1001: {executable: "container-a@kube-system/pod-1"},
+		},
+	}
+	c := makeTestCollector(client, finder)
+
+	metrics := collectMetrics(c)
+
+	running := map[string]map[string]string{}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_process_accounting_running") {
+		labels := getMetricLabels(m)
+		running[labels["pid"]] = labels
+		if want := boolToFloat(labels["pid"] == "1001"); getMetricValue(m) != want {
+			t.Errorf("process_accounting_running{pid=%q} = %v, want %v", labels["pid"], getMetricValue(m), want)
+		}
+	}
+	if running["1001"]["pod_name"] != "pod-1" || running["1001"]["type"] != processTypeGraphics {
+		t.Errorf("unexpected labels for running process %v", running["1001"])
+	}
+	// PID 1002 exited before it could be attributed.
+	if running["1002"]["pod_name"] != orphanPod {
+		t.Errorf("unexpected labels for exited process %v", running["1002"])
+	}
+	runTime := findMetrics(metrics, "nvidia_gpu_process_accounting_run_time_seconds_total")
+	if len(runTime) != 2 {
+		t.Fatalf("expected 2 run time counters, got %d", len(runTime))
+	}
+
+	// PID 1001 exits and its process can no longer be found, but NVML still
+	// has its record.
+	dev := &client.devices[0]
+	dev.pids, dev.mems = nil, nil
+	dev.accounting[0].IsRunning = false
+	dev.accounting[0].RunTime = 45
+	delete(finder.processes, 1001)
+
+	metrics = collectMetrics(c)
+
+	for _, m := range findMetrics(metrics, "nvidia_gpu_process_accounting_run_time_seconds_total") {
+		labels := getMetricLabels(m)
+		if labels["pid"] != "1001" {
+			continue
+		}
+		if labels["pod_name"] != "pod-1" || labels["namespace"] != "kube-system" {
+			t.Errorf("expected exited process to keep its attribution, got %v", labels)
+		}
+		if v := getCounterValue(m); v != 45 {
+			t.Errorf("process_accounting_run_time_seconds_total = %v, want 45", v)
+		}
+	}
+	if used := findMetrics(metrics, "nvidia_gpu_process_memory_used_bytes"); len(used) != 0 {
+		t.Errorf("expected no process_memory_used_bytes for exited processes, got %d", len(used))
+	}
+}
+
+func TestCollect_AccountingRecycledPID(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].pids = []uint{1001}
+	client.devices[0].mems = []uint64{4096}
+	client.devices[0].accounting = []GPUAccountingStats{
+		{PID: 1001, StartTime: 1700000000, RunTime: 30, IsRunning: true},
+	}
+	finder := &mockProcessFinder{
+		processes: map[int]*mockProcessInfo{
+			1001: {executable: "container-a@kube-system/pod-1"},
+		},
+	}
+	c := makeTestCollector(client, finder)
+	collectMetrics(c)
+
+	// The process exits and its PID is reused by a process of another pod,
+	// while NVML still has the record of the first one and an exited
+	// process that the exporter never saw running.
+	dev := &client.devices[0]
+	dev.accounting = []GPUAccountingStats{
+		{PID: 1001, StartTime: 1700000000, RunTime: 45},
+		{PID: 1001, StartTime: 1700000100, RunTime: 5, IsRunning: true},
+		{PID: 1002, StartTime: 1700000050, RunTime: 10},
+	}
+	finder.processes[1001] = &mockProcessInfo{executable: "container-b@default/pod-2"}
+	finder.processes[1002] = &mockProcessInfo{executable: "container-c@default/pod-3"}
+
+	metrics := collectMetrics(c)
+
+	pods := map[string]string{}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_process_accounting_run_time_seconds_total") {
+		labels := getMetricLabels(m)
+		if _, ok := pods[labels["pid"]]; ok {
+			t.Errorf("pid %s exported more than once", labels["pid"])
+		}
+		pods[labels["pid"]] = labels["pod_name"]
+	}
+	want := map[string]string{"1001": "pod-2", "1002": orphanPod}
+	if !reflect.DeepEqual(pods, want) {
+		t.Errorf("pod per pid = %v, want %v", pods, want)
+	}
+	if len(c.accountedPIDs["gpu-0"]) != 2 {
+		t.Errorf("expected 2 remembered processes, got %d", len(c.accountedPIDs["gpu-0"]))
+	}
+}
+
+func TestCollect_AccountingLimit(t *testing.T) {
+	client := newTestClient(1)
+	for i := 0; i < 5; i++ {
+		client.devices[0].accounting = append(client.devices[0].accounting,
+			GPUAccountingStats{PID: uint(1000 + i), StartTime: float64(1700000000 + i)})
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+	c.SetAccountingLimit(2)
+
+	metrics := collectMetrics(c)
+
+	var pids []string
+	for _, m := range findMetrics(metrics, "nvidia_gpu_process_accounting_start_time_seconds") {
+		pids = append(pids, getMetricLabels(m)["pid"])
+	}
+	sort.Strings(pids)
+	if want := []string{"1003", "1004"}; !reflect.DeepEqual(pids, want) {
+		t.Errorf("exported pids = %v, want the most recent %v", pids, want)
+	}
+}
+
+func TestCollect_EncoderAndFBCSessions(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].pids = []uint{1001, 1002}
+	client.devices[0].mems = []uint64{4096, 2048}
+	client.devices[0].encoder = &GPUSessions{
+		Stats: GPUSessionStats{Sessions: 3, AverageFPS: 40, AverageLatency: 0.002},
+		Sessions: []GPUSession{
+			{PID: 1001, AverageFPS: 30, AverageLatency: 0.002},
+			{PID: 1001, AverageFPS: 60, AverageLatency: 0.004},
+			{PID: 1002, AverageFPS: 30, AverageLatency: 0.001},
+		},
+	}
+	client.devices[0].fbc = &GPUSessions{Stats: GPUSessionStats{Sessions: 1, AverageFPS: 60, AverageLatency: 0.01}}
+	finder := &mockProcessFinder{
+		processes: map[int]*mockProcessInfo{
+			1001: {executable: "transcoder@media/pod-1"},
+			1002: {executable: "transcoder@media/pod-2"},
+		},
+	}
+	c := makeTestCollector(client, finder)
+
+	metrics := collectMetrics(c)
+
+	for name, want := range map[string]float64{
+		"nvidia_gpu_encoder_sessions":                3,
+		"nvidia_gpu_encoder_average_fps":             40,
+		"nvidia_gpu_encoder_average_latency_seconds": 0.002,
+		"nvidia_gpu_fbc_sessions":                    1,
+		"nvidia_gpu_fbc_average_fps":                 60,
+	} {
+		if m := findMetrics(metrics, name); len(m) != 1 || getMetricValue(m[0]) != want {
+			t.Errorf("expected %s = %v", name, want)
+		}
+	}
+
+	type stats struct{ sessions, fps, latency float64 }
+	perPod := map[string]*stats{}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_process_encoder_sessions") {
+		perPod[getMetricLabels(m)["pod_name"]] = &stats{sessions: getMetricValue(m)}
+	}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_process_encoder_average_fps") {
+		perPod[getMetricLabels(m)["pod_name"]].fps = getMetricValue(m)
+	}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_process_encoder_average_latency_seconds") {
+		perPod[getMetricLabels(m)["pod_name"]].latency = getMetricValue(m)
+	}
+	if s := perPod["pod-1"]; s == nil || *s != (stats{2, 45, 0.003}) {
+		t.Errorf("unexpected pod-1 encoder stats %+v", s)
+	}
+	if s := perPod["pod-2"]; s == nil || *s != (stats{1, 30, 0.001}) {
+		t.Errorf("unexpected pod-2 encoder stats %+v", s)
+	}
+	if fbc := findMetrics(metrics, "nvidia_gpu_process_fbc_sessions"); len(fbc) != 0 {
+		t.Errorf("expected no process_fbc_sessions without per-session details, got %d", len(fbc))
+	}
+}
+
+func TestCollect_CachesDevices(t *testing.T) {
+	status := &GPUDeviceStatus{UsedMemory: 100, DutyCycle: 10, PowerUsage: 100, Temperature: 50, EncUtil: 5, DecUtil: 5}
+	client := &mockNVMLClient{
+		deviceCount: 2,
+		devices: []mockNVMLDevice{
+			{minor: "0", uuid: "gpu-0", model: "V100", totalMemory: 16384, status: status},
+			{minor: "1", uuid: "gpu-1", model: "V100", totalMemory: 16384, status: status},
+		},
+	}
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	collectMetrics(c)
+	collectMetrics(c)
+	if client.newDeviceCalls != 2 {
+		t.Fatalf("expected each device to be opened once, got %d NewDevice calls", client.newDeviceCalls)
+	}
+
+	// The device at index 1 is replaced: only it is opened again, and the
+	// old one is dropped from the cache.
+	client.devices[0].topology = map[string]*GPUTopologyLink{"gpu-2": {PCIe: topologySingleSwitch}}
+	client.devices[1] = mockNVMLDevice{minor: "1", uuid: "gpu-2", model: "A100", totalMemory: 40960, status: status}
+	metrics := collectMetrics(c)
+	if client.newDeviceCalls != 3 {
+		t.Errorf("expected only the new device to be opened, got %d NewDevice calls", client.newDeviceCalls)
+	}
+	if _, ok := c.devices["gpu-1"]; ok {
+		t.Error("expected the replaced device to be dropped from the cache")
+	}
+	names := map[string]string{}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_memory_total_bytes") {
+		labels := getMetricLabels(m)
+		names[labels["uuid"]] = labels["name"]
+	}
+	if len(names) != 2 || names["gpu-0"] != "V100" || names["gpu-2"] != "A100" {
+		t.Errorf("unexpected devices after replacement %v", names)
+	}
+	if len(c.topology) != 1 {
+		t.Fatalf("expected 1 cached topology link, got %d", len(c.topology))
+	}
+
+	// A device that disappears is dropped as well, along with the state
+	// kept for it across scrapes.
+	client.deviceCount = 1
+	collectMetrics(c)
+	if len(c.devices) != 1 {
+		t.Errorf("expected 1 cached device, got %d", len(c.devices))
+	}
+	if _, ok := c.energy["gpu-2"]; ok {
+		t.Error("expected the energy of the removed device to be dropped")
+	}
+	if _, ok := c.lastSeen["gpu-2"]; ok {
+		t.Error("expected the utilization timestamp of the removed device to be dropped")
+	}
+	if len(c.topology) != 0 {
+		t.Errorf("expected no topology links with a single device, got %d", len(c.topology))
+	}
+	if _, ok := c.knownDevices[1]; ok {
+		t.Error("expected the removed device to be forgotten")
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+// cachedDevice is an open device along with its static attributes, which are
+// read once when the device is opened.
+type cachedDevice struct {
+	dev         NVMLDevice
+	minor       string
+	uuid        string
+	name        string
+	totalMemory float64
+	// info is the identity of the device, or nil until it has been read.
+	info *GPUDeviceInfo
+}
+
+func (d *cachedDevice) labelValues() []string {
+	return []string{d.minor, d.uuid, d.name}
+}
+
+// device returns the device at index idx. Only its UUID is looked up; the
+// device is opened and its static attributes read the first time the UUID is
+// seen.
+func (c *Collector) device(idx int) (*cachedDevice, error) {
+	uuid, err := c.nvmlClient.GetDeviceUUID(uint(idx))
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := c.devices[uuid]; ok {
+		return d, nil
+	}
+
+	dev, err := c.nvmlClient.NewDevice(uint(idx))
+	if err != nil {
+		return nil, err
+	}
+	d := &cachedDevice{
+		dev:         dev,
+		minor:       dev.GetMinor(),
+		uuid:        uuid,
+		name:        dev.GetModel(),
+		totalMemory: dev.GetTotalMemory(),
+	}
+	c.devices[uuid] = d
+	return d, nil
+}
+
+// pruneDevices drops the cached devices whose UUID isn't in seen, so that
+// devices that were replaced or removed are opened again if they return,
+// along with the per device state kept across scrapes. Devices past
+// numDevices are forgotten.
+func (c *Collector) pruneDevices(seen map[string]bool, numDevices int) {
+	for uuid := range c.devices {
+		if !seen[uuid] {
+			delete(c.devices, uuid)
+		}
+	}
+	for uuid := range c.energy {
+		if !seen[uuid] {
+			delete(c.energy, uuid)
+		}
+	}
+	for uuid := range c.lastSeen {
+		if !seen[uuid] {
+			delete(c.lastSeen, uuid)
+		}
+	}
+	for uuid := range c.accountedPIDs {
+		if !seen[uuid] {
+			delete(c.accountedPIDs, uuid)
+		}
+	}
+	for key := range c.topology {
+		if !seen[key[0]] || !seen[key[1]] {
+			delete(c.topology, key)
+		}
+	}
+	for i := range c.knownDevices {
+		if i >= numDevices {
+			delete(c.knownDevices, i)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// infoLabels are the labels of nvidia_gpu_info in addition to the device
+// labels, in the order of GPUDeviceInfo.labelValues.
+var infoLabels = []string{
+	"pci_bus_id", "serial", "vbios_version", "board_part_number", "brand",
+	"architecture", "cuda_compute_capability",
+	"inforom_image_version", "inforom_oem_version", "inforom_ecc_version", "inforom_power_version",
+}
+
+// GPUDeviceInfo holds the static identity of a device. Fields the device
+// doesn't report are empty.
+type GPUDeviceInfo struct {
+	PCIBusID              string
+	Serial                string
+	VBIOSVersion          string
+	BoardPartNumber       string
+	Brand                 string
+	Architecture          string
+	CUDAComputeCapability string
+	InfoROMImageVersion   string
+	InfoROMOEMVersion     string
+	InfoROMECCVersion     string
+	InfoROMPowerVersion   string
+	// NUMANode is the NUMA node the device is attached to, or nil if
+	// unknown.
+	NUMANode *float64
+	// CPUAffinity lists the CPUs local to the device in the kernel's CPU
+	// list format (e.g. "0-23,48-71"), or is empty if unknown.
+	CPUAffinity string
+}
+
+func (i *GPUDeviceInfo) labelValues() []string {
+	return []string{
+		i.PCIBusID, i.Serial, i.VBIOSVersion, i.BoardPartNumber, i.Brand,
+		i.Architecture, i.CUDAComputeCapability,
+		i.InfoROMImageVersion, i.InfoROMOEMVersion, i.InfoROMECCVersion, i.InfoROMPowerVersion,
+	}
+}
+
+// collectDeviceInfo exports nvidia_gpu_info for d, so that other metrics can
+// be joined with its identity on the device labels, along with the device's
+// NUMA node and CPU affinity. The identity is static, so it is only read
+// until it has been read successfully.
+func (c *Collector) collectDeviceInfo(d *cachedDevice, lv []string) {
+	if d.info == nil {
+		info, err := d.dev.GetDeviceInfo()
+		if errors.Is(err, errNotSupported) {
+			return
+		}
+		if err != nil {
+			log.Printf("GetDeviceInfo() error for device %s: %v", d.uuid, err)
+			return
+		}
+		if info == nil {
+			return
+		}
+		d.info = info
+	}
+	info := d.info
+	c.info.WithLabelValues(withLabels(lv, info.labelValues()...)...).Set(1)
+	setOptional(c.numaNode, info.NUMANode, lv...)
+	if info.CPUAffinity != "" {
+		c.cpuAffinity.WithLabelValues(withLabels(lv, info.CPUAffinity)...).Set(1)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Compute modes, as label values of nvidia_gpu_compute_mode.
+const (
+	computeModeDefault          = "default"
+	computeModeExclusiveThread  = "exclusive_thread"
+	computeModeProhibited       = "prohibited"
+	computeModeExclusiveProcess = "exclusive_process"
+)
+
+var computeModes = []string{
+	computeModeDefault, computeModeExclusiveThread, computeModeProhibited, computeModeExclusiveProcess,
+}
+
+// GPUDeviceMode holds the configured modes of a device. Fields are empty or
+// nil when the device doesn't report them.
+type GPUDeviceMode struct {
+	// ComputeMode is one of the computeMode* values.
+	ComputeMode   string
+	Persistence   *bool
+	DisplayActive *bool
+	DisplayMode   *bool
+	Accounting    *bool
+}
+
+// collectDeviceMode exports the performance state and configured modes of dev.
+func (c *Collector) collectDeviceMode(dev NVMLDevice, lv []string, devStatus *GPUDeviceStatus) {
+	setOptional(c.performanceState, devStatus.PerformanceState, lv...)
+
+	mode, err := dev.GetDeviceMode()
+	if errors.Is(err, errNotSupported) {
+		return
+	}
+	if err != nil {
+		log.Printf("GetDeviceMode() error for device %s: %v", dev.GetUUID(), err)
+		return
+	}
+	if mode == nil {
+		return
+	}
+
+	if mode.ComputeMode != "" {
+		for _, m := range computeModes {
+			c.computeMode.WithLabelValues(withLabels(lv, m)...).Set(boolToFloat(m == mode.ComputeMode))
+		}
+	}
+	for _, m := range []struct {
+		g *prometheus.GaugeVec
+		v *bool
+	}{
+		{c.persistenceMode, mode.Persistence},
+		{c.displayActive, mode.DisplayActive},
+		{c.displayMode, mode.DisplayMode},
+		{c.accountingMode, mode.Accounting},
+	} {
+		if m.v != nil {
+			m.g.WithLabelValues(lv...).Set(boolToFloat(*m.v))
+		}
+	}
+}
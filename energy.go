@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	energySourceNVML     = "nvml"
+	energySourceExporter = "exporter"
+)
+
+// GPUPowerLimits holds the power limits of a device in milliwatts. Each
+// field is nil when the device or driver doesn't report it.
+type GPUPowerLimits struct {
+	ManagementLimit *float64
+	EnforcedLimit   *float64
+	DefaultLimit    *float64
+	MinLimit        *float64
+	MaxLimit        *float64
+}
+
+// energyIntegrator estimates the energy consumed by a device from its power
+// samples, for drivers that don't report total energy consumption.
+type energyIntegrator struct {
+	lastTime  time.Time
+	lastPower float64 // milliwatts
+	joules    float64
+}
+
+// add records a power sample taken at t and reports the energy accumulated so
+// far. ok is false until a second sample makes an estimate possible.
+func (e *energyIntegrator) add(t time.Time, milliwatts float64) (joules float64, ok bool) {
+	ok = !e.lastTime.IsZero()
+	if ok && t.After(e.lastTime) {
+		// Trapezoidal rule over the interval since the previous sample.
+		e.joules += (e.lastPower + milliwatts) / 2 / 1000 * t.Sub(e.lastTime).Seconds()
+	}
+	e.lastTime, e.lastPower = t, milliwatts
+	return e.joules, ok
+}
+
+// collectEnergy exports the energy counter of a device, preferring the total
+// reported by NVML and integrating power samples otherwise, along with the
+// device's power limits.
+func (c *Collector) collectEnergy(ch chan<- prometheus.Metric, uuid string, lv []string, devStatus *GPUDeviceStatus) {
+	if devStatus.EnergyJoules != nil {
+		delete(c.energy, uuid)
+		ch <- prometheus.MustNewConstMetric(c.energyTotal, prometheus.CounterValue, *devStatus.EnergyJoules,
+			withLabels(lv, energySourceNVML)...)
+	} else {
+		e, ok := c.energy[uuid]
+		if !ok {
+			e = &energyIntegrator{}
+			c.energy[uuid] = e
+		}
+		if joules, ok := e.add(c.now(), devStatus.PowerUsage); ok {
+			ch <- prometheus.MustNewConstMetric(c.energyTotal, prometheus.CounterValue, joules,
+				withLabels(lv, energySourceExporter)...)
+		}
+	}
+
+	if l := devStatus.PowerLimits; l != nil {
+		setOptional(c.powerLimit, l.ManagementLimit, withLabels(lv, "management")...)
+		setOptional(c.powerLimit, l.EnforcedLimit, withLabels(lv, "enforced")...)
+		setOptional(c.powerLimit, l.DefaultLimit, withLabels(lv, "default")...)
+		setOptional(c.powerLimit, l.MinLimit, withLabels(lv, "min")...)
+		setOptional(c.powerLimit, l.MaxLimit, withLabels(lv, "max")...)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "strconv"
+
+// Fan control policies, as label values of nvidia_gpu_fan_control_policy.
+const (
+	fanControlPolicyAuto   = "auto"
+	fanControlPolicyManual = "manual"
+)
+
+var fanControlPolicies = []string{fanControlPolicyAuto, fanControlPolicyManual}
+
+// GPUFan holds the state of one fan of a device. Fields are empty or nil when
+// the device doesn't report them.
+type GPUFan struct {
+	Fan int
+	// SpeedPercent is the current fan speed as a percentage of its maximum.
+	SpeedPercent *float64
+	// TargetSpeedPercent is the speed the fan is being driven towards.
+	TargetSpeedPercent *float64
+	// ControlPolicy is one of the fanControlPolicy* values.
+	ControlPolicy string
+}
+
+// collectFans exports the speed and control policy of each fan of a device.
+func (c *Collector) collectFans(lv []string, fans []GPUFan) {
+	for _, f := range fans {
+		flv := withLabels(lv, strconv.Itoa(f.Fan))
+		setOptional(c.fanSpeed, f.SpeedPercent, flv...)
+		setOptional(c.fanTargetSpeed, f.TargetSpeedPercent, flv...)
+		if f.ControlPolicy != "" {
+			for _, p := range fanControlPolicies {
+				c.fanControlPolicy.WithLabelValues(withLabels(flv, p)...).Set(boolToFloat(p == f.ControlPolicy))
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.yaml.in/yaml/v2"
+)
+
+// Field metric types, as values of FieldConfig.Type.
+const (
+	fieldTypeGauge   = "gauge"
+	fieldTypeCounter = "counter"
+)
+
+var (
+	fieldNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// descNameRE extracts the metric name from the String form of a
+	// prometheus.Desc, which is the only way the name is exposed.
+	descNameRE = regexp.MustCompile(`fqName: "([^"]*)"`)
+)
+
+// FieldConfig maps an NVML field id to a metric.
+type FieldConfig struct {
+	// ID is the NVML field id, a NVML_FI_* value.
+	ID uint32 `yaml:"id"`
+	// Name is the metric name without the nvidia_gpu_ prefix.
+	Name string `yaml:"name"`
+	// Type is "gauge" (the default) or "counter".
+	Type string `yaml:"type"`
+	Help string `yaml:"help"`
+	// Scale multiplies the value reported by NVML; it defaults to 1.
+	Scale float64 `yaml:"scale"`
+}
+
+type fieldsConfig struct {
+	Fields []FieldConfig `yaml:"fields"`
+}
+
+// LoadFieldConfig reads the field value metrics from the YAML file at path
+// and validates them.
+func LoadFieldConfig(path string) ([]FieldConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg fieldsConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	builtin := builtinMetricNames()
+	ids := make(map[uint32]bool)
+	names := make(map[string]bool)
+	for i := range cfg.Fields {
+		f := &cfg.Fields[i]
+		if !fieldNameRE.MatchString(f.Name) {
+			return nil, fmt.Errorf("field %d: invalid metric name %q", f.ID, f.Name)
+		}
+		if builtin[prometheus.BuildFQName(namespace, "", f.Name)] {
+			return nil, fmt.Errorf("field %d: metric name %q is used by a built-in metric", f.ID, f.Name)
+		}
+		if ids[f.ID] {
+			return nil, fmt.Errorf("field %d: configured more than once", f.ID)
+		}
+		if names[f.Name] {
+			return nil, fmt.Errorf("field %d: metric name %q used more than once", f.ID, f.Name)
+		}
+		ids[f.ID], names[f.Name] = true, true
+
+		switch f.Type {
+		case "":
+			f.Type = fieldTypeGauge
+		case fieldTypeGauge, fieldTypeCounter:
+		default:
+			return nil, fmt.Errorf("field %d: unknown type %q", f.ID, f.Type)
+		}
+		if f.Scale == 0 {
+			f.Scale = 1
+		}
+		if f.Help == "" {
+			f.Help = fmt.Sprintf("NVML field %d", f.ID)
+		}
+	}
+	return cfg.Fields, nil
+}
+
+// builtinMetricNames returns the names of the metrics the collector exports
+// itself, which configured fields must not reuse.
+func builtinMetricNames() map[string]bool {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		newCollector(nil, nil).Describe(ch)
+		close(ch)
+	}()
+	names := make(map[string]bool)
+	for d := range ch {
+		if m := descNameRE.FindStringSubmatch(d.String()); m != nil {
+			names[m[1]] = true
+		}
+	}
+	return names
+}
+
+// GPUFieldValue is the value of an NVML field. Value is nil if the device
+// doesn't report the field.
+type GPUFieldValue struct {
+	ID    uint32
+	Value *float64
+}
+
+type fieldMetric struct {
+	FieldConfig
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+}
+
+// SetFields configures the NVML fields exported by the collector. It must be
+// called before the collector is registered.
+func (c *Collector) SetFields(fields []FieldConfig) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.fields = make(map[uint32]fieldMetric, len(fields))
+	c.fieldIDs = make([]uint32, 0, len(fields))
+	for _, f := range fields {
+		valueType := prometheus.GaugeValue
+		if f.Type == fieldTypeCounter {
+			valueType = prometheus.CounterValue
+		}
+		c.fields[f.ID] = fieldMetric{FieldConfig: f, desc: newDesc(f.Name, f.Help, labels), valueType: valueType}
+		c.fieldIDs = append(c.fieldIDs, f.ID)
+	}
+}
+
+// collectFieldValues fetches the configured fields of dev in one call and
+// exports them, scaled, with the device labels.
+func (c *Collector) collectFieldValues(ch chan<- prometheus.Metric, dev NVMLDevice, lv []string) {
+	if len(c.fieldIDs) == 0 {
+		return
+	}
+	values, err := dev.GetFieldValues(c.fieldIDs)
+	if errors.Is(err, errNotSupported) {
+		return
+	}
+	if err != nil {
+		log.Printf("GetFieldValues() error for device %s: %v", dev.GetUUID(), err)
+		return
+	}
+	for _, v := range values {
+		f, ok := c.fields[v.ID]
+		if !ok || v.Value == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(f.desc, f.valueType, *v.Value*f.Scale, lv...)
+	}
+}
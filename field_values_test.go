@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFieldConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fields.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFieldConfig(t *testing.T) {
+	path := writeFieldConfig(t, `
+fields:
+  - id: 155
+    name: power_usage_instant_milliwatts
+    scale: 1000
+  - id: 61
+    name: energy_field_joules_total
+    type: counter
+    help: Total energy consumption
+`)
+
+	fields, err := LoadFieldConfig(path)
+	if err != nil {
+		t.Fatalf("LoadFieldConfig() error: %v", err)
+	}
+	if len(fields) != 2 {
+		t.Fatalf("expected 2 fields, got %d", len(fields))
+	}
+	if f := fields[0]; f.Type != fieldTypeGauge || f.Scale != 1000 || f.Help != "NVML field 155" {
+		t.Errorf("unexpected defaults for field 155: %+v", f)
+	}
+	if f := fields[1]; f.Type != fieldTypeCounter || f.Scale != 1 || f.Help != "Total energy consumption" {
+		t.Errorf("unexpected field 61: %+v", f)
+	}
+}
+
+func TestLoadFieldConfig_Invalid(t *testing.T) {
+	for _, tc := range []struct {
+		name, config, wantErr string
+	}{
+		{"bad name", "fields:\n  - id: 1\n    name: bad-name\n", "invalid metric name"},
+		{"bad type", "fields:\n  - id: 1\n    name: a\n    type: histogram\n", "unknown type"},
+		{"duplicate id", "fields:\n  - id: 1\n    name: a\n  - id: 1\n    name: b\n", "more than once"},
+		{"duplicate name", "fields:\n  - id: 1\n    name: a\n  - id: 2\n    name: a\n", "more than once"},
+		{"unknown key", "fields:\n  - id: 1\n    name: a\n    scal: 2\n", "parsing"},
+		{"built-in name", "fields:\n  - id: 1\n    name: temperature_celsius\n", "built-in metric"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadFieldConfig(writeFieldConfig(t, tc.config))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("LoadFieldConfig() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func fieldTestClient() *mockNVMLClient {
+	client := newTestClient(1)
+	client.devices[0].fieldValues = map[uint32]float64{155: 250, 61: 1234}
+	return client
+}
+
+func TestCollect_FieldValues(t *testing.T) {
+	client := fieldTestClient()
+	c := makeTestCollector(client, &mockProcessFinder{})
+	c.SetFields([]FieldConfig{
+		{ID: 155, Name: "power_instant_milliwatts", Type: fieldTypeGauge, Help: "Instant power", Scale: 1000},
+		{ID: 61, Name: "field_energy_joules_total", Type: fieldTypeCounter, Help: "Energy", Scale: 1},
+		{ID: 999, Name: "unreported", Type: fieldTypeGauge, Help: "Not reported", Scale: 1},
+	})
+
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + reported fields(2)
+	if len(metrics) != 12 {
+		t.Fatalf("expected 12 metrics, got %d", len(metrics))
+	}
+	power := findMetrics(metrics, "nvidia_gpu_power_instant_milliwatts")
+	if len(power) != 1 || getMetricValue(power[0]) != 250000 {
+		t.Errorf("expected power_instant_milliwatts = 250000")
+	}
+	if labels := getMetricLabels(power[0]); labels["uuid"] != "gpu-0" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	energy := findMetrics(metrics, "nvidia_gpu_field_energy_joules_total")
+	if len(energy) != 1 || getCounterValue(energy[0]) != 1234 {
+		t.Errorf("expected field_energy_joules_total = 1234")
+	}
+
+	// All fields are fetched in a single call per device.
+	calls := client.devices[0].fieldCalls
+	if len(calls) != 1 || len(calls[0]) != 3 {
+		t.Errorf("expected 1 GetFieldValues call for 3 fields, got %v", calls)
+	}
+}
+
+func TestCollect_FieldValuesError(t *testing.T) {
+	client := fieldTestClient()
+	client.devices[0].fieldValuesErr = errors.New("nvml: Unknown Error")
+	c := makeTestCollector(client, &mockProcessFinder{})
+	c.SetFields([]FieldConfig{{ID: 155, Name: "power_instant_milliwatts", Type: fieldTypeGauge, Help: "Instant power", Scale: 1}})
+
+	metrics := collectMetrics(c)
+
+	if len(metrics) != 10 {
+		t.Errorf("expected 10 metrics, got %d", len(metrics))
+	}
+}
+
+func TestCollect_NoFieldsConfigured(t *testing.T) {
+	client := fieldTestClient()
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	collectMetrics(c)
+
+	if calls := client.devices[0].fieldCalls; len(calls) != 0 {
+		t.Errorf("expected no GetFieldValues calls, got %d", len(calls))
+	}
+}
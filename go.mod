@@ -5,21 +5,20 @@ go 1.23.0
 toolchain go1.24.13
 
 require (
+	github.com/NVIDIA/go-nvml v0.12.4-0
 	github.com/prometheus/client_golang v1.23.2
 	github.com/prometheus/client_model v0.6.2
 	github.com/vaniot-s/go-ps v0.0.0-20190715095905-3e5104f6aa1e
-	github.com/vaniot-s/nvml v0.0.0-20190717090753-48b24d2c20db
+	go.yaml.in/yaml/v2 v2.4.2
 )
 
 require (
-	github.com/NVIDIA/gpu-monitoring-tools v0.0.0-20190814234429-0474d08c7a07 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/prometheus/common v0.66.1 // indirect
 	github.com/prometheus/procfs v0.16.1 // indirect
-	go.yaml.in/yaml/v2 v2.4.2 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	google.golang.org/protobuf v1.36.8 // indirect
 )
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Reasons a device is unhealthy, as label values of nvidia_gpu_healthy. When
+// several apply, the first in this order is reported.
+const (
+	healthGPULost           = "gpu_lost"
+	healthResetRequired     = "reset_required"
+	healthNotSupported      = "not_supported"
+	healthNVMLError         = "nvml_error"
+	healthRowRemapFailure   = "row_remap_failure"
+	healthXID               = "xid"
+	healthECCUncorrected    = "ecc_uncorrected"
+	healthPendingRetirement = "pending_retirement"
+	healthThermalSlowdown   = "thermal_slowdown"
+)
+
+// xidHealthWindow is how long a device is reported unhealthy after a
+// critical XID error.
+var xidHealthWindow = 10 * time.Minute
+
+// defaultXIDHealthCodes are the XID errors that make a device unhealthy by
+// default: those that point at the hardware (ECC errors, page retirement and
+// row remapping, NVLink errors, the GPU falling off the bus) rather than at
+// the application that triggered them, like 13 or 31.
+var defaultXIDHealthCodes = []uint64{48, 63, 64, 74, 79, 92, 94, 95}
+
+// errGPULost and errResetRequired are returned by NVMLDevice implementations
+// when NVML reports that the GPU is lost or requires a reset.
+var (
+	errGPULost       = errors.New("GPU is lost")
+	errResetRequired = errors.New("GPU requires reset")
+)
+
+// classifyNVMLError maps an error from NVML to a health reason.
+func classifyNVMLError(err error) string {
+	switch {
+	case errors.Is(err, errNotSupported):
+		return healthNotSupported
+	case errors.Is(err, errGPULost):
+		return healthGPULost
+	case errors.Is(err, errResetRequired):
+		return healthResetRequired
+	}
+	return healthNVMLError
+}
+
+// deviceHealth gathers the signals of one device during a scrape.
+type deviceHealth struct {
+	remapFailure, pendingRetirement bool
+}
+
+// healthReason combines the signals of a device whose status was read into a
+// single health reason, or "" if the device is healthy.
+func (c *Collector) healthReason(uuid string, devStatus *GPUDeviceStatus, h deviceHealth) string {
+	if h.remapFailure {
+		return healthRowRemapFailure
+	}
+	c.xidMu.Lock()
+	lastXID, ok := c.lastXIDAt[uuid]
+	c.xidMu.Unlock()
+	if ok && c.now().Sub(lastXID) < xidHealthWindow {
+		return healthXID
+	}
+	for _, e := range devStatus.ECCErrors {
+		if e.ErrorType == eccDoubleBit && e.CounterType == eccVolatile && e.Count > 0 {
+			return healthECCUncorrected
+		}
+	}
+	if h.pendingRetirement {
+		return healthPendingRetirement
+	}
+	if r := devStatus.ClockEventReasons; r != nil && r.Active&(clockEventHwThermalSlowdown|clockEventSwThermalSlowdown) != 0 {
+		return healthThermalSlowdown
+	}
+	if t := devStatus.TemperatureThresholds; t != nil && t.Slowdown != nil && devStatus.Temperature >= *t.Slowdown {
+		return healthThermalSlowdown
+	}
+	return ""
+}
+
+// setHealth exports whether the device could be read and its health reason.
+func (c *Collector) setHealth(lv []string, up bool, reason string) {
+	c.up.WithLabelValues(lv...).Set(boolToFloat(up))
+	c.healthy.WithLabelValues(withLabels(lv, reason)...).Set(boolToFloat(reason == ""))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClassifyNVMLError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{errGPULost, healthGPULost},
+		{fmt.Errorf("opening device: %w", errGPULost), healthGPULost},
+		{errResetRequired, healthResetRequired},
+		{errNotSupported, healthNotSupported},
+		{errors.New("nvml: Unknown Error"), healthNVMLError},
+	} {
+		if got := classifyNVMLError(tc.err); got != tc.want {
+			t.Errorf("classifyNVMLError(%q) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+// health returns the up value and the healthy value and reason of the only
+// device.
+func health(t *testing.T, c *Collector) (up, healthy float64, reason string) {
+	t.Helper()
+	metrics := collectMetrics(c)
+	ups := findMetrics(metrics, "nvidia_gpu_up")
+	healthies := findMetrics(metrics, "nvidia_gpu_healthy")
+	if len(ups) != 1 || len(healthies) != 1 {
+		t.Fatalf("expected 1 up and 1 healthy metric, got %d and %d", len(ups), len(healthies))
+	}
+	return getMetricValue(ups[0]), getMetricValue(healthies[0]), getMetricLabels(healthies[0])["reason"]
+}
+
+func TestCollect_HealthyDevice(t *testing.T) {
+	c := makeTestCollector(newTestClient(1), &mockProcessFinder{})
+
+	up, healthy, reason := health(t, c)
+
+	if up != 1 || healthy != 1 || reason != "" {
+		t.Errorf("got up=%v healthy=%v reason=%q, want a healthy device", up, healthy, reason)
+	}
+}
+
+func TestCollect_DeviceFellOffTheBus(t *testing.T) {
+	client := newTestClient(1)
+	c := makeTestCollector(client, &mockProcessFinder{})
+	health(t, c)
+
+	client.devices[0].openErr = errGPULost
+	metrics := collectMetrics(c)
+
+	up := findMetrics(metrics, "nvidia_gpu_up")
+	if len(up) != 1 || getMetricValue(up[0]) != 0 {
+		t.Fatalf("expected the lost device to be reported down")
+	}
+	if labels := getMetricLabels(up[0]); labels["uuid"] != "gpu-0" || labels["minor_number"] != "0" {
+		t.Errorf("expected the labels of the last scrape, got %v", labels)
+	}
+	healthy := findMetrics(metrics, "nvidia_gpu_healthy")
+	if len(healthy) != 1 || getMetricLabels(healthy[0])["reason"] != healthGPULost {
+		t.Errorf("expected healthy{reason=%q}", healthGPULost)
+	}
+}
+
+func TestCollect_NeverSeenDeviceIsNotReported(t *testing.T) {
+	client := newTestClient(1)
+	client.devices[0].openErr = errGPULost
+	c := makeTestCollector(client, &mockProcessFinder{})
+
+	if up := findMetrics(collectMetrics(c), "nvidia_gpu_up"); len(up) != 0 {
+		t.Errorf("expected no up metric for a device without known labels, got %d", len(up))
+	}
+}
+
+func TestCollect_HealthReasons(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(c *Collector, dev *mockNVMLDevice)
+		want  string
+	}{
+		{
+			name: "row remap failure",
+			setup: func(c *Collector, dev *mockNVMLDevice) {
+				dev.remapped = &GPURemappedRows{Failure: true, Pending: true}
+			},
+			want: healthRowRemapFailure,
+		},
+		{
+			name: "recent xid",
+			setup: func(c *Collector, dev *mockNVMLDevice) {
+				c.lastXIDAt["gpu-0"] = c.now().Add(-time.Minute)
+			},
+			want: healthXID,
+		},
+		{
+			name: "old xid",
+			setup: func(c *Collector, dev *mockNVMLDevice) {
+				c.lastXIDAt["gpu-0"] = c.now().Add(-time.Hour)
+			},
+			want: "",
+		},
+		{
+			name: "uncorrected volatile ecc",
+			setup: func(c *Collector, dev *mockNVMLDevice) {
+				dev.status.ECCErrors = []GPUECCErrorCount{
+					{ErrorType: eccDoubleBit, CounterType: eccAggregate, Location: eccLocationDeviceMemory, Count: 3},
+					{ErrorType: eccDoubleBit, CounterType: eccVolatile, Location: eccLocationDeviceMemory, Count: 1},
+				}
+			},
+			want: healthECCUncorrected,
+		},
+		{
+			name: "aggregate ecc only",
+			setup: func(c *Collector, dev *mockNVMLDevice) {
+				dev.status.ECCErrors = []GPUECCErrorCount{
+					{ErrorType: eccDoubleBit, CounterType: eccAggregate, Location: eccLocationDeviceMemory, Count: 3},
+				}
+			},
+			want: "",
+		},
+		{
+			name: "pending page retirement",
+			setup: func(c *Collector, dev *mockNVMLDevice) {
+				dev.retired = &GPURetiredPages{DoubleBitECC: 1, Pending: true}
+			},
+			want: healthPendingRetirement,
+		},
+		{
+			name: "thermal clock event",
+			setup: func(c *Collector, dev *mockNVMLDevice) {
+				dev.status.ClockEventReasons = &GPUClockEventReasons{Active: clockEventHwThermalSlowdown}
+			},
+			want: healthThermalSlowdown,
+		},
+		{
+			name: "above slowdown threshold",
+			setup: func(c *Collector, dev *mockNVMLDevice) {
+				dev.status.Temperature = 90
+				dev.status.TemperatureThresholds = &GPUTemperatureThresholds{Slowdown: float64Ptr(89)}
+			},
+			want: healthThermalSlowdown,
+		},
+		{
+			name: "status reset required",
+			setup: func(c *Collector, dev *mockNVMLDevice) {
+				dev.statusErr = errResetRequired
+			},
+			want: healthResetRequired,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newTestClient(1)
+			c := makeTestCollector(client, &mockProcessFinder{})
+			c.now = func() time.Time { return time.Unix(1700000000, 0) }
+			tc.setup(c, &client.devices[0])
+
+			up, healthy, reason := health(t, c)
+
+			if reason != tc.want {
+				t.Errorf("reason = %q, want %q", reason, tc.want)
+			}
+			if want := boolToFloat(tc.want == ""); healthy != want {
+				t.Errorf("healthy = %v, want %v", healthy, want)
+			}
+			if want := boolToFloat(client.devices[0].statusErr == nil); up != want {
+				t.Errorf("up = %v, want %v", up, want)
+			}
+		})
+	}
+}
@@ -7,22 +7,63 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/vaniot-s/nvml"
 )
 
-var addr = flag.String("web.listen-address", ":9445", "Address to listen on for web interface and telemetry.")
+var (
+	addr            = flag.String("web.listen-address", ":9445", "Address to listen on for web interface and telemetry.")
+	fieldConfig     = flag.String("collector.field-config", "", "Path to a YAML file of NVML field ids to export as metrics.")
+	accountingLimit = flag.Int("collector.accounting-max-processes", defaultAccountingLimit, "Maximum number of processes per device exported by the accounting metrics, keeping the most recently started. 0 exports every process NVML keeps a record of.")
+	xidHealthCodes  = flag.String("collector.xid-health-codes", "48,63,64,74,79,92,94,95", "Comma separated XID errors that make a device unhealthy. Other XIDs are only counted.")
+	pollInterval    = flag.Duration("collector.poll-interval", 0, "Interval at which NVML is polled in the background, with scrapes served from the latest poll. 0 queries NVML on every scrape.")
+)
+
+// initNVML initializes lib and refreshes the driver info exported by c.
+// Any reinitialisation of NVML must go through it.
+func initNVML(lib nvml.Interface, c *Collector) error {
+	if err := nvmlError(lib.Init()); err != nil {
+		return err
+	}
+	c.UpdateDriverInfo()
+	return nil
+}
 
 func main() {
 	flag.Parse()
 
-	if err := nvml.Init(); err != nil {
+	lib := nvml.New()
+	collector := NewCollector(lib)
+	collector.SetAccountingLimit(*accountingLimit)
+	codes, err := ParseXIDCodes(*xidHealthCodes)
+	if err != nil {
+		log.Fatalf("Couldn't parse --collector.xid-health-codes: %v", err)
+	}
+	collector.SetXIDHealthCodes(codes)
+	if *fieldConfig != "" {
+		fields, err := LoadFieldConfig(*fieldConfig)
+		if err != nil {
+			log.Fatalf("Couldn't load field config: %v", err)
+		}
+		collector.SetFields(fields)
+	}
+	if err := initNVML(lib, collector); err != nil {
 		log.Fatalf("Couldn't initialize nvml: %v. Make sure NVML is in the shared library search path.", err)
 	}
-	defer nvml.Shutdown()
+	defer lib.Shutdown()
+
+	if *pollInterval > 0 {
+		collector.StartPolling(*pollInterval, nil)
+	}
+	prometheus.MustRegister(collector, newBuildInfo())
 
-	prometheus.MustRegister(NewCollector())
+	if xids, err := NewXIDEventSource(lib); err != nil {
+		log.Printf("Couldn't register for XID events, XID metrics disabled: %v", err)
+	} else {
+		defer xids.Close()
+		go collector.WatchXIDs(xids, nil)
+	}
 
 	log.Printf("Starting GPU exporter on %s", *addr)
 	log.Fatalf("ListenAndServe error: %v", http.ListenAndServe(*addr, promhttp.Handler()))
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+)
+
+// GPUMIGDevice is a MIG compute instance carved out of a physical device.
+type GPUMIGDevice struct {
+	GPUInstanceID     uint
+	ComputeInstanceID uint
+	// Profile is the MIG profile name, e.g. "1g.10gb".
+	Profile     string
+	UUID        string
+	TotalMemory float64
+	UsedMemory  float64
+	// Utilization is the SM utilization in percent, or nil if the driver
+	// doesn't report it for MIG instances.
+	Utilization *float64
+	// PIDs are the processes running on this instance.
+	PIDs []uint
+}
+
+// migPlacement identifies the MIG instance a process runs on. Both fields are
+// empty for processes on devices without MIG.
+type migPlacement struct {
+	gpuInstanceID, computeInstanceID string
+}
+
+// collectMIG exports memory and utilization per MIG instance of dev and
+// returns the instance each listed process runs on, keyed by PID.
+func (c *Collector) collectMIG(dev NVMLDevice, lv []string) map[uint]migPlacement {
+	migDevices, err := dev.GetMIGDevices()
+	if errors.Is(err, errNotSupported) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("GetMIGDevices() error for device %s: %v", dev.GetUUID(), err)
+		return nil
+	}
+
+	placements := make(map[uint]migPlacement)
+	for _, mig := range migDevices {
+		p := migPlacement{
+			gpuInstanceID:     strconv.FormatUint(uint64(mig.GPUInstanceID), 10),
+			computeInstanceID: strconv.FormatUint(uint64(mig.ComputeInstanceID), 10),
+		}
+		migLv := withLabels(lv, p.gpuInstanceID, p.computeInstanceID, mig.Profile)
+		c.migUsedMemory.WithLabelValues(migLv...).Set(mig.UsedMemory)
+		c.migTotalMemory.WithLabelValues(migLv...).Set(mig.TotalMemory)
+		setOptional(c.migUtilization, mig.Utilization, migLv...)
+		for _, pid := range mig.PIDs {
+			placements[pid] = p
+		}
+	}
+	return placements
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GPUNVLink is the state and counters of a single NVLink of a device.
+// Counters are nil when the driver doesn't report them.
+type GPUNVLink struct {
+	Link   uint
+	Active bool
+	// RemoteBusID and RemoteUUID identify the peer; either may be empty,
+	// e.g. when the peer is an NVSwitch rather than a GPU.
+	RemoteBusID string
+	RemoteUUID  string
+
+	RxBytes        *float64
+	TxBytes        *float64
+	CRCFlitErrors  *float64
+	CRCDataErrors  *float64
+	ReplayErrors   *float64
+	RecoveryErrors *float64
+}
+
+// collectNVLinks exports per-link NVLink metrics. Devices without NVLink are
+// skipped without logging.
+func (c *Collector) collectNVLinks(ch chan<- prometheus.Metric, dev NVMLDevice, lv []string) {
+	links, err := dev.GetNVLinks()
+	if errors.Is(err, errNotSupported) {
+		return
+	}
+	if err != nil {
+		log.Printf("GetNVLinks() error for device %s: %v", dev.GetUUID(), err)
+		return
+	}
+
+	for _, l := range links {
+		link := strconv.FormatUint(uint64(l.Link), 10)
+		c.nvlinkActive.WithLabelValues(withLabels(lv, link, l.RemoteBusID, l.RemoteUUID)...).Set(boolToFloat(l.Active))
+
+		linkLv := withLabels(lv, link)
+		for _, m := range []struct {
+			desc *prometheus.Desc
+			v    *float64
+		}{
+			{c.nvlinkRxBytes, l.RxBytes},
+			{c.nvlinkTxBytes, l.TxBytes},
+		} {
+			if m.v != nil {
+				ch <- prometheus.MustNewConstMetric(m.desc, prometheus.CounterValue, *m.v, linkLv...)
+			}
+		}
+		for _, e := range []struct {
+			typ string
+			v   *float64
+		}{
+			{"crc_flit", l.CRCFlitErrors},
+			{"crc_data", l.CRCDataErrors},
+			{"replay", l.ReplayErrors},
+			{"recovery", l.RecoveryErrors},
+		} {
+			if e.v != nil {
+				ch <- prometheus.MustNewConstMetric(c.nvlinkErrors, prometheus.CounterValue, *e.v,
+					withLabels(linkLv, e.typ)...)
+			}
+		}
+	}
+}
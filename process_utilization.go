@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// utilizationWindow aggregates the utilization samples of one process over
+// a scrape interval.
+type utilizationWindow struct {
+	samples                       float64
+	sm, mem, enc, dec             float64
+	maxSm, maxMem, maxEnc, maxDec uint
+}
+
+func (w *utilizationWindow) add(s GPUProcessUtilization) {
+	w.samples++
+	w.sm += float64(s.SmUtil)
+	w.mem += float64(s.MemUtil)
+	w.enc += float64(s.EncUtil)
+	w.dec += float64(s.DecUtil)
+	w.maxSm = max(w.maxSm, s.SmUtil)
+	w.maxMem = max(w.maxMem, s.MemUtil)
+	w.maxEnc = max(w.maxEnc, s.EncUtil)
+	w.maxDec = max(w.maxDec, s.DecUtil)
+}
+
+// collectProcessUtilization consumes every utilization sample of dev taken
+// since the previous scrape and exports the mean and max per process. Only
+// processes in pidInfo are exported.
+func (c *Collector) collectProcessUtilization(dev NVMLDevice, uuid, minor string, pidInfo map[int]pidMeta) {
+	lastSeen := c.lastSeen[uuid]
+	samples, err := dev.GetProcessUtilization(lastSeen)
+	if err != nil {
+		log.Printf("GetProcessUtilization() error: %v", err)
+		return
+	}
+
+	windows := make(map[uint]*utilizationWindow)
+	for _, s := range samples {
+		lastSeen = max(lastSeen, s.TimeStamp)
+		if s.PID == 0 {
+			continue
+		}
+		w, ok := windows[s.PID]
+		if !ok {
+			w = &utilizationWindow{}
+			windows[s.PID] = w
+		}
+		w.add(s)
+	}
+	c.lastSeen[uuid] = lastSeen
+
+	// Processes with the same labels, e.g. the workers of one container, are
+	// summed so that they don't overwrite each other.
+	type sums struct{ mean, max [4]float64 }
+	perLabels := make(map[pidMeta]*sums)
+	for pid, w := range windows {
+		info, ok := pidInfo[int(pid)]
+		if !ok {
+			continue
+		}
+		p, ok := perLabels[info]
+		if !ok {
+			p = &sums{}
+			perLabels[info] = p
+		}
+		for i, v := range []struct {
+			sum      float64
+			maxValue uint
+		}{
+			{w.dec, w.maxDec},
+			{w.enc, w.maxEnc},
+			{w.mem, w.maxMem},
+			{w.sm, w.maxSm},
+		} {
+			p.mean[i] += v.sum / w.samples
+			p.max[i] += float64(v.maxValue)
+		}
+	}
+
+	for info, p := range perLabels {
+		plv := info.labelValues(minor)
+		for i, m := range []struct{ mean, max *prometheus.GaugeVec }{
+			{c.pDecUtil, c.pDecUtilMax},
+			{c.pEncUtil, c.pEncUtilMax},
+			{c.pMemUtil, c.pMemUtilMax},
+			{c.pSmUtil, c.pSmUtilMax},
+		} {
+			m.mean.WithLabelValues(plv...).Set(p.mean[i])
+			m.max.WithLabelValues(plv...).Set(p.max[i])
+		}
+	}
+}
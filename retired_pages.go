@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// GPURetiredPages is the page retirement state of a device. Page retirement
+// is used by GPUs before Ampere.
+type GPURetiredPages struct {
+	SingleBitECC float64
+	DoubleBitECC float64
+	// Pending is true if pages are waiting to be retired on the next reboot.
+	Pending bool
+}
+
+// GPURemappedRows is the row remapping state of a device. Row remapping
+// replaces page retirement on Ampere and newer GPUs.
+type GPURemappedRows struct {
+	Correctable   float64
+	Uncorrectable float64
+	// Pending is true if a remapping is waiting for a GPU reset.
+	Pending bool
+	// Failure is true if a row could not be remapped.
+	Failure bool
+}
+
+// collectRetiredPages exports page retirement and row remapping state and
+// returns the health signals derived from it. Devices only support one of the
+// two, so errNotSupported is expected.
+func (c *Collector) collectRetiredPages(dev NVMLDevice, lv []string) (h deviceHealth) {
+	pages, err := dev.GetRetiredPages()
+	switch {
+	case errors.Is(err, errNotSupported):
+	case err != nil:
+		log.Printf("GetRetiredPages() error for device %s: %v", dev.GetUUID(), err)
+	case pages != nil:
+		c.retiredPages.WithLabelValues(withLabels(lv, "single_bit_ecc")...).Set(pages.SingleBitECC)
+		c.retiredPages.WithLabelValues(withLabels(lv, "double_bit_ecc")...).Set(pages.DoubleBitECC)
+		c.retiredPagesPending.WithLabelValues(lv...).Set(boolToFloat(pages.Pending))
+		h.pendingRetirement = pages.Pending
+	}
+
+	rows, err := dev.GetRemappedRows()
+	switch {
+	case errors.Is(err, errNotSupported):
+	case err != nil:
+		log.Printf("GetRemappedRows() error for device %s: %v", dev.GetUUID(), err)
+	case rows != nil:
+		c.remappedRows.WithLabelValues(withLabels(lv, "correctable")...).Set(rows.Correctable)
+		c.remappedRows.WithLabelValues(withLabels(lv, "uncorrectable")...).Set(rows.Uncorrectable)
+		c.remappedRowsPending.WithLabelValues(lv...).Set(boolToFloat(rows.Pending))
+		c.remappedRowsFailure.WithLabelValues(lv...).Set(boolToFloat(rows.Failure))
+		h.pendingRetirement = h.pendingRetirement || rows.Pending
+		h.remapFailure = rows.Failure
+	}
+	return h
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GPUSessionStats summarizes the active encoder or frame buffer capture
+// sessions of a device, vGPU instance or process.
+type GPUSessionStats struct {
+	Sessions   float64
+	AverageFPS float64
+	// AverageLatency is in seconds.
+	AverageLatency float64
+}
+
+// GPUSession is a single encoder or frame buffer capture session.
+type GPUSession struct {
+	PID        uint
+	AverageFPS float64
+	// AverageLatency is in seconds.
+	AverageLatency float64
+}
+
+// GPUSessions holds the encoder or frame buffer capture sessions of a
+// device. Sessions is empty if NVML only reports the device-wide stats.
+type GPUSessions struct {
+	Stats    GPUSessionStats
+	Sessions []GPUSession
+}
+
+// sessionGauges are the device and process gauges of one kind of session.
+type sessionGauges struct {
+	sessions, fps, latency    *prometheus.GaugeVec
+	pSessions, pFPS, pLatency *prometheus.GaugeVec
+}
+
+// collectSessions exports the encoder and frame buffer capture sessions of
+// dev, both device-wide and per process. Sessions of processes that resolve
+// to the same labels, such as several processes of one container, are
+// aggregated.
+func (c *Collector) collectSessions(dev NVMLDevice, lv []string, minor string, pidInfo map[int]pidMeta) {
+	for _, s := range []struct {
+		call   string
+		get    func() (*GPUSessions, error)
+		gauges sessionGauges
+	}{
+		{"GetEncoderSessions", dev.GetEncoderSessions, c.encoderSessions},
+		{"GetFBCSessions", dev.GetFBCSessions, c.fbcSessions},
+	} {
+		sessions, err := s.get()
+		if errors.Is(err, errNotSupported) {
+			continue
+		}
+		if err != nil {
+			log.Printf("%s() error for device %s: %v", s.call, dev.GetUUID(), err)
+			continue
+		}
+		if sessions == nil {
+			continue
+		}
+		g := s.gauges
+		g.sessions.WithLabelValues(lv...).Set(sessions.Stats.Sessions)
+		g.fps.WithLabelValues(lv...).Set(sessions.Stats.AverageFPS)
+		g.latency.WithLabelValues(lv...).Set(sessions.Stats.AverageLatency)
+
+		perProcess := make(map[pidMeta]*GPUSessionStats)
+		for _, sess := range sessions.Sessions {
+			info, ok := pidInfo[int(sess.PID)]
+			if !ok {
+				info = c.resolvePID(sess.PID)
+			}
+			p, ok := perProcess[info]
+			if !ok {
+				p = &GPUSessionStats{}
+				perProcess[info] = p
+			}
+			p.Sessions++
+			p.AverageFPS += sess.AverageFPS
+			p.AverageLatency += sess.AverageLatency
+		}
+		for info, p := range perProcess {
+			plv := info.labelValues(minor)
+			g.pSessions.WithLabelValues(plv...).Set(p.Sessions)
+			g.pFPS.WithLabelValues(plv...).Set(p.AverageFPS / p.Sessions)
+			g.pLatency.WithLabelValues(plv...).Set(p.AverageLatency / p.Sessions)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxFailedPolls is the number of consecutive failed polls after which the
+// metrics of the last successful poll are no longer served, and the devices
+// it knew of are reported down instead.
+const maxFailedPolls = 3
+
+// snapshot holds the metrics of one NVML poll. It is never modified once
+// stored, so scrapes can read it without taking the collector's lock.
+type snapshot struct {
+	metrics []prometheus.Metric
+	time    time.Time
+}
+
+// frozenMetric is the value of a metric at the time it was collected. The
+// gauges of the collector are reset and set again by every poll, so they
+// can't be kept in a snapshot as they are.
+type frozenMetric struct {
+	desc *prometheus.Desc
+	pb   *dto.Metric
+}
+
+func (m frozenMetric) Desc() *prometheus.Desc { return m.desc }
+
+func (m frozenMetric) Write(out *dto.Metric) error {
+	out.Label = m.pb.Label
+	out.Gauge = m.pb.Gauge
+	out.Counter = m.pb.Counter
+	out.Untyped = m.pb.Untyped
+	out.TimestampMs = m.pb.TimestampMs
+	return nil
+}
+
+// StartPolling switches the collector to polling mode: NVML is queried every
+// interval in the background until stop is closed, and Collect serves the
+// metrics of the latest poll. The first poll is done before StartPolling
+// returns, so that scrapes never find the collector without a snapshot.
+func (c *Collector) StartPolling(interval time.Duration, stop <-chan struct{}) {
+	c.updateSnapshot()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.updateSnapshot()
+			}
+		}
+	}()
+}
+
+// updateSnapshot queries NVML and replaces the snapshot served by Collect. If
+// NVML can't be queried the previous snapshot is kept, so that its time shows
+// how stale it is, until maxFailedPolls polls in a row have failed.
+func (c *Collector) updateSnapshot() {
+	var err error
+	metrics := freeze(func(ch chan<- prometheus.Metric) { err = c.collect(ch) })
+	if err == nil {
+		c.failedPolls = 0
+		c.snapshot.Store(&snapshot{metrics: metrics, time: c.now()})
+		return
+	}
+
+	c.failedPolls++
+	prev := c.snapshot.Load()
+	if prev == nil {
+		// Without a previous snapshot, serve one that is as old as can be.
+		prev = &snapshot{time: time.Unix(0, 0)}
+		c.snapshot.Store(prev)
+	}
+	if c.failedPolls < maxFailedPolls {
+		return
+	}
+	c.snapshot.Store(&snapshot{metrics: freeze(func(ch chan<- prometheus.Metric) { c.collectDown(ch, err) }), time: prev.time})
+}
+
+// collectDown reports every device seen by a previous poll down because of
+// err, and unhealthy with the matching reason.
+func (c *Collector) collectDown(ch chan<- prometheus.Metric, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.up.Reset()
+	c.healthy.Reset()
+	for _, lv := range c.knownDevices {
+		c.setHealth(lv, false, classifyNVMLError(err))
+	}
+	c.up.Collect(ch)
+	c.healthy.Collect(ch)
+}
+
+// freeze runs collect and returns the metrics it sent with their values at
+// that time.
+func freeze(collect func(ch chan<- prometheus.Metric)) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		var metrics []prometheus.Metric
+		for m := range ch {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				log.Printf("Error reading metric %s: %v", m.Desc(), err)
+				continue
+			}
+			metrics = append(metrics, frozenMetric{desc: m.Desc(), pb: &pb})
+		}
+		done <- metrics
+	}()
+	collect(ch)
+	close(ch)
+	return <-done
+}
+
+// collectSnapshot emits the metrics of the latest poll along with its time.
+func (c *Collector) collectSnapshot(ch chan<- prometheus.Metric, s *snapshot) {
+	for _, m := range s.metrics {
+		ch <- m
+	}
+	ch <- prometheus.MustNewConstMetric(c.lastUpdate, prometheus.GaugeValue, float64(s.time.UnixNano())/1e9)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollect_ServesSnapshotInPollingMode(t *testing.T) {
+	client := newTestClient(1)
+	c := makeTestCollector(client, &mockProcessFinder{})
+	c.now = func() time.Time { return time.Unix(1700000000, 0) }
+	stop := make(chan struct{})
+	defer close(stop)
+
+	c.StartPolling(time.Hour, stop)
+	client.devices[0].status.UsedMemory = 200
+	metrics := collectMetrics(c)
+
+	// numDevices(1) + device(7) + health(2) + last update(1)
+	if len(metrics) != 11 {
+		t.Fatalf("expected 11 metrics, got %d", len(metrics))
+	}
+	if used := findMetrics(metrics, "nvidia_gpu_memory_used_bytes"); len(used) != 1 || getMetricValue(used[0]) != 100 {
+		t.Errorf("expected memory_used_bytes = 100 from the snapshot")
+	}
+	lastUpdate := findMetrics(metrics, "nvidia_gpu_last_update_timestamp_seconds")
+	if len(lastUpdate) != 1 || getMetricValue(lastUpdate[0]) != 1700000000 {
+		t.Errorf("expected last_update_timestamp_seconds = 1700000000")
+	}
+
+	// The snapshot is frozen: the next poll doesn't change metrics already
+	// handed out, only the ones served afterwards.
+	c.now = func() time.Time { return time.Unix(1700000015, 0) }
+	c.updateSnapshot()
+	if v := getMetricValue(findMetrics(metrics, "nvidia_gpu_memory_used_bytes")[0]); v != 100 {
+		t.Errorf("expected the served snapshot to keep memory_used_bytes = 100, got %v", v)
+	}
+	metrics = collectMetrics(c)
+	if used := findMetrics(metrics, "nvidia_gpu_memory_used_bytes"); len(used) != 1 || getMetricValue(used[0]) != 200 {
+		t.Errorf("expected memory_used_bytes = 200 after the next poll")
+	}
+	if v := getMetricValue(findMetrics(metrics, "nvidia_gpu_last_update_timestamp_seconds")[0]); v != 1700000015 {
+		t.Errorf("last_update_timestamp_seconds = %v, want 1700000015", v)
+	}
+}
+
+func TestUpdateSnapshot_FailedPollKeepsPreviousSnapshot(t *testing.T) {
+	client := newTestClient(1)
+	c := makeTestCollector(client, &mockProcessFinder{})
+	c.now = func() time.Time { return time.Unix(1700000000, 0) }
+	stop := make(chan struct{})
+	defer close(stop)
+	c.StartPolling(time.Hour, stop)
+
+	client.deviceCountErr = errors.New("nvml gone")
+	c.now = func() time.Time { return time.Unix(1700000015, 0) }
+	c.updateSnapshot()
+
+	metrics := collectMetrics(c)
+	if used := findMetrics(metrics, "nvidia_gpu_memory_used_bytes"); len(used) != 1 || getMetricValue(used[0]) != 100 {
+		t.Errorf("expected memory_used_bytes = 100 from the previous snapshot")
+	}
+	if v := getMetricValue(findMetrics(metrics, "nvidia_gpu_last_update_timestamp_seconds")[0]); v != 1700000000 {
+		t.Errorf("last_update_timestamp_seconds = %v, want 1700000000", v)
+	}
+}
+
+func TestUpdateSnapshot_RepeatedFailuresReportDevicesDown(t *testing.T) {
+	client := newTestClient(2)
+	c := makeTestCollector(client, &mockProcessFinder{})
+	c.now = func() time.Time { return time.Unix(1700000000, 0) }
+	stop := make(chan struct{})
+	defer close(stop)
+	c.StartPolling(time.Hour, stop)
+
+	client.deviceCountErr = errGPULost
+	for i := 1; i < maxFailedPolls; i++ {
+		c.updateSnapshot()
+	}
+	if used := findMetrics(collectMetrics(c), "nvidia_gpu_memory_used_bytes"); len(used) != 2 {
+		t.Fatalf("expected the previous snapshot until %d polls failed, got %d memory metrics", maxFailedPolls, len(used))
+	}
+
+	c.updateSnapshot()
+	metrics := collectMetrics(c)
+
+	// up(2) + healthy(2) + last update(1)
+	if len(metrics) != 5 {
+		t.Fatalf("expected 5 metrics, got %d", len(metrics))
+	}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_up") {
+		if v := getMetricValue(m); v != 0 {
+			t.Errorf("up{uuid=%q} = %v, want 0", getMetricLabels(m)["uuid"], v)
+		}
+	}
+	for _, m := range findMetrics(metrics, "nvidia_gpu_healthy") {
+		if reason := getMetricLabels(m)["reason"]; reason != healthGPULost {
+			t.Errorf("healthy reason = %q, want %q", reason, healthGPULost)
+		}
+	}
+	if v := getMetricValue(findMetrics(metrics, "nvidia_gpu_last_update_timestamp_seconds")[0]); v != 1700000000 {
+		t.Errorf("last_update_timestamp_seconds = %v, want 1700000000", v)
+	}
+
+	// The next successful poll is served again.
+	client.deviceCountErr = nil
+	c.updateSnapshot()
+	if used := findMetrics(collectMetrics(c), "nvidia_gpu_memory_used_bytes"); len(used) != 2 {
+		t.Errorf("expected 2 memory metrics after recovering, got %d", len(used))
+	}
+}
+
+func TestStartPolling_FailedFirstPoll(t *testing.T) {
+	client := newTestClient(1)
+	client.deviceCountErr = errors.New("nvml gone")
+	c := makeTestCollector(client, &mockProcessFinder{})
+	stop := make(chan struct{})
+	defer close(stop)
+	c.StartPolling(time.Hour, stop)
+
+	metrics := collectMetrics(c)
+	if len(metrics) != 1 {
+		t.Fatalf("expected only last_update_timestamp_seconds, got %d metrics", len(metrics))
+	}
+	if v := getMetricValue(findMetrics(metrics, "nvidia_gpu_last_update_timestamp_seconds")[0]); v != 0 {
+		t.Errorf("last_update_timestamp_seconds = %v, want 0", v)
+	}
+}
+
+func TestStartPolling_PollsInBackground(t *testing.T) {
+	c := makeTestCollector(newTestClient(1), &mockProcessFinder{})
+	stop := make(chan struct{})
+	defer close(stop)
+
+	c.StartPolling(time.Millisecond, stop)
+	first := c.snapshot.Load()
+	if first == nil {
+		t.Fatal("expected a snapshot as soon as polling starts")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.snapshot.Load() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a background poll")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCollect_SnapshotIsConsistentWithDescribe(t *testing.T) {
+	c := makeTestCollector(newTestClient(1), &mockProcessFinder{})
+	stop := make(chan struct{})
+	defer close(stop)
+	c.StartPolling(time.Hour, stop)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	if _, err := reg.Gather(); err != nil {
+		t.Errorf("Gather() error: %v", err)
+	}
+}
+
+func TestCollect_NoLastUpdateWithoutPolling(t *testing.T) {
+	c := makeTestCollector(newTestClient(1), &mockProcessFinder{})
+
+	if m := findMetrics(collectMetrics(c), "nvidia_gpu_last_update_timestamp_seconds"); len(m) != 0 {
+		t.Errorf("expected no last_update_timestamp_seconds, got %d", len(m))
+	}
+}
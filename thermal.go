@@ -0,0 +1,39 @@
+package main
+
+const (
+	thresholdShutdown  = "shutdown"
+	thresholdSlowdown  = "slowdown"
+	thresholdMemoryMax = "memory_max"
+	thresholdGPUMax    = "gpu_max"
+)
+
+// GPUTemperatureThresholds holds the thermal thresholds of a device in
+// celsius. Each field is nil when the device or driver doesn't report it.
+type GPUTemperatureThresholds struct {
+	// Shutdown is the temperature at which the device shuts down.
+	Shutdown *float64
+	// Slowdown is the temperature at which the device starts throttling.
+	Slowdown *float64
+	// MemoryMax is the maximum operating temperature of the memory.
+	MemoryMax *float64
+	// GPUMax is the maximum operating temperature of the GPU core.
+	GPUMax *float64
+}
+
+// collectThermal exports the memory temperature and thermal thresholds of a
+// device, and the headroom of the core temperature to the slowdown threshold.
+func (c *Collector) collectThermal(lv []string, devStatus *GPUDeviceStatus) {
+	setOptional(c.memoryTemperature, devStatus.MemoryTemperature, lv...)
+
+	t := devStatus.TemperatureThresholds
+	if t == nil {
+		return
+	}
+	setOptional(c.temperatureThreshold, t.Shutdown, withLabels(lv, thresholdShutdown)...)
+	setOptional(c.temperatureThreshold, t.Slowdown, withLabels(lv, thresholdSlowdown)...)
+	setOptional(c.temperatureThreshold, t.MemoryMax, withLabels(lv, thresholdMemoryMax)...)
+	setOptional(c.temperatureThreshold, t.GPUMax, withLabels(lv, thresholdGPUMax)...)
+	if t.Slowdown != nil {
+		c.slowdownHeadroom.WithLabelValues(lv...).Set(*t.Slowdown - devStatus.Temperature)
+	}
+}
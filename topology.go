@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+)
+
+// Topology levels between two devices, from closest to farthest, as label
+// values of nvidia_gpu_topology_info.
+const (
+	topologyNVLink       = "nvlink"
+	topologySameBoard    = "same_board"
+	topologySingleSwitch = "single_switch"
+	topologyMultiSwitch  = "multiple_switches"
+	topologyHostBridge   = "host_bridge"
+	topologySameCPU      = "same_cpu"
+	topologyCrossCPU     = "cross_cpu"
+)
+
+// GPUTopologyLink describes how a device is connected to a peer device.
+type GPUTopologyLink struct {
+	// PCIe is the closest common PCIe ancestor of the two devices, one of
+	// the topology* values other than topologyNVLink.
+	PCIe string
+	// NVLinks is the number of NVLinks between the two devices.
+	NVLinks int
+}
+
+// level reports the closest connection between the two devices.
+func (l *GPUTopologyLink) level() string {
+	if l.NVLinks > 0 {
+		return topologyNVLink
+	}
+	return l.PCIe
+}
+
+// topologyDevice is a device seen during a scrape, kept so its topology can be
+// queried against the other devices once they have all been enumerated.
+type topologyDevice struct {
+	dev  NVMLDevice
+	uuid string
+}
+
+// collectTopology exports the topology between every ordered pair of devs.
+// Topology doesn't change while the driver is loaded, so links are queried
+// once and cached by UUID pair.
+func (c *Collector) collectTopology(devs []topologyDevice) {
+	for _, a := range devs {
+		for _, b := range devs {
+			if a.uuid == b.uuid {
+				continue
+			}
+			key := [2]string{a.uuid, b.uuid}
+			link, ok := c.topology[key]
+			if !ok {
+				var err error
+				link, err = a.dev.GetTopology(b.dev)
+				if errors.Is(err, errNotSupported) {
+					continue
+				}
+				if err != nil {
+					log.Printf("GetTopology() error for devices %s and %s: %v", a.uuid, b.uuid, err)
+					continue
+				}
+				if link == nil {
+					continue
+				}
+				c.topology[key] = link
+			}
+			c.topologyInfo.WithLabelValues(a.uuid, b.uuid, link.level(), link.PCIe, strconv.Itoa(link.NVLinks)).Set(1)
+		}
+	}
+}
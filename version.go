@@ -0,0 +1,29 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Set at build time with
+// -ldflags "-X main.version=... -X main.revision=...".
+var (
+	version  = "dev"
+	revision = "unknown"
+)
+
+// newBuildInfo returns gpu_exporter_build_info, a constant 1 labeled with
+// the exporter's version, revision and Go version.
+func newBuildInfo() prometheus.Collector {
+	g := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gpu_exporter",
+			Name:      "build_info",
+			Help:      "A metric with a constant '1' value labeled by version, revision and goversion from which gpu_exporter was built",
+		},
+		[]string{"version", "revision", "goversion"},
+	)
+	g.WithLabelValues(version, revision, runtime.Version()).Set(1)
+	return g
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewBuildInfo(t *testing.T) {
+	ch := make(chan prometheus.Metric, 1)
+	newBuildInfo().Collect(ch)
+	close(ch)
+
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	info := findMetrics(metrics, "gpu_exporter_build_info")
+	if len(info) != 1 {
+		t.Fatalf("expected 1 build info metric, got %d", len(info))
+	}
+	if v := getMetricValue(info[0]); v != 1 {
+		t.Errorf("build info = %v, want 1", v)
+	}
+	want := map[string]string{"version": version, "revision": revision, "goversion": runtime.Version()}
+	for name, value := range want {
+		if got := getMetricLabels(info[0])[name]; got != value {
+			t.Errorf("label %s = %q, want %q", name, got, value)
+		}
+	}
+}
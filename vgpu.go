@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// VGPUHost lists the vGPU instances running on a physical device of a
+// hypervisor host.
+type VGPUHost interface {
+	// GetVGPUInstances returns the active vGPU instances, or
+	// errNotSupported if the device isn't in vGPU host mode.
+	GetVGPUInstances() ([]GPUVGPUInstance, error)
+}
+
+// GPUVGPUInstance is a vGPU instance running on a physical device.
+type GPUVGPUInstance struct {
+	ID string
+	// Type is the vGPU type name, e.g. "GRID A100-4C".
+	Type string
+	// VMID identifies the owning VM, as a domain id or UUID depending on
+	// the hypervisor.
+	VMID            string
+	FramebufferUsed float64
+	// Utilization fields are in percent, or nil if not reported.
+	SMUtilization      *float64
+	MemoryUtilization  *float64
+	EncoderUtilization *float64
+	DecoderUtilization *float64
+	// Encoder and FBC are nil if session stats aren't reported.
+	Encoder *GPUSessionStats
+	FBC     *GPUSessionStats
+}
+
+// collectVGPUs exports framebuffer usage, utilization and session stats per
+// vGPU instance of dev.
+func (c *Collector) collectVGPUs(dev NVMLDevice, lv []string) {
+	instances, err := dev.GetVGPUInstances()
+	if errors.Is(err, errNotSupported) {
+		return
+	}
+	if err != nil {
+		log.Printf("GetVGPUInstances() error for device %s: %v", dev.GetUUID(), err)
+		return
+	}
+
+	for _, v := range instances {
+		vlv := withLabels(lv, v.ID, v.Type, v.VMID)
+		c.vgpuFBUsed.WithLabelValues(vlv...).Set(v.FramebufferUsed)
+		setOptional(c.vgpuSMUtil, v.SMUtilization, vlv...)
+		setOptional(c.vgpuMemUtil, v.MemoryUtilization, vlv...)
+		setOptional(c.vgpuEncUtil, v.EncoderUtilization, vlv...)
+		setOptional(c.vgpuDecUtil, v.DecoderUtilization, vlv...)
+		if s := v.Encoder; s != nil {
+			c.vgpuEncSessions.WithLabelValues(vlv...).Set(s.Sessions)
+			c.vgpuEncFPS.WithLabelValues(vlv...).Set(s.AverageFPS)
+			c.vgpuEncLatency.WithLabelValues(vlv...).Set(s.AverageLatency)
+		}
+		if s := v.FBC; s != nil {
+			c.vgpuFBCSessions.WithLabelValues(vlv...).Set(s.Sessions)
+			c.vgpuFBCFPS.WithLabelValues(vlv...).Set(s.AverageFPS)
+			c.vgpuFBCLatency.WithLabelValues(vlv...).Set(s.AverageLatency)
+		}
+	}
+	c.vgpuInstances.WithLabelValues(lv...).Set(float64(len(instances)))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xidWaitTimeout bounds how long WatchXIDs blocks in a single wait, and so
+// how quickly it notices that it should stop.
+var xidWaitTimeout = time.Second
+
+// XIDEvent is a critical XID error reported by NVML for a device.
+type XIDEvent struct {
+	UUID string
+	XID  uint64
+}
+
+// XIDEventSource delivers XID events registered for all devices.
+type XIDEventSource interface {
+	// Wait blocks for up to timeout for the next event. It returns a nil
+	// event and no error if nothing arrived in time.
+	Wait(timeout time.Duration) (*XIDEvent, error)
+	Close()
+}
+
+// WatchXIDs records every event from src in the XID metrics until stop is
+// closed. It is meant to run in its own goroutine, since Collect only polls
+// and would miss transient XIDs.
+func (c *Collector) WatchXIDs(src XIDEventSource, stop <-chan struct{}) {
+	devices := make(map[string][]string)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		ev, err := src.Wait(xidWaitTimeout)
+		if err != nil {
+			log.Printf("XID event wait error: %v", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(xidWaitTimeout):
+			}
+			continue
+		}
+		if ev == nil {
+			continue
+		}
+
+		lv, ok := devices[ev.UUID]
+		if !ok {
+			devices = c.deviceLabelValues()
+			if lv, ok = devices[ev.UUID]; !ok {
+				lv = []string{"", ev.UUID, ""}
+			}
+		}
+		c.xidErrors.WithLabelValues(withLabels(lv, strconv.FormatUint(ev.XID, 10))...).Inc()
+		c.lastXID.WithLabelValues(lv...).Set(float64(ev.XID))
+		now := c.now()
+		c.lastXIDTime.WithLabelValues(lv...).Set(float64(now.UnixNano()) / 1e9)
+		c.xidMu.Lock()
+		if c.xidHealthCodes[ev.XID] {
+			c.lastXIDAt[ev.UUID] = now
+		}
+		c.xidMu.Unlock()
+	}
+}
+
+// SetXIDHealthCodes sets the XID errors that make a device unhealthy for
+// xidHealthWindow. The other XIDs are only counted.
+func (c *Collector) SetXIDHealthCodes(codes []uint64) {
+	c.xidMu.Lock()
+	defer c.xidMu.Unlock()
+
+	c.xidHealthCodes = make(map[uint64]bool, len(codes))
+	for _, x := range codes {
+		c.xidHealthCodes[x] = true
+	}
+}
+
+// ParseXIDCodes parses a comma separated list of XID codes.
+func ParseXIDCodes(s string) ([]uint64, error) {
+	var codes []uint64
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		x, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid XID %q", f)
+		}
+		codes = append(codes, x)
+	}
+	return codes, nil
+}
+
+// deviceLabelValues returns the device label values of every device, keyed
+// by UUID.
+func (c *Collector) deviceLabelValues() map[string][]string {
+	c.Lock()
+	defer c.Unlock()
+
+	devices := make(map[string][]string)
+	numDevices, err := c.nvmlClient.GetDeviceCount()
+	if err != nil {
+		log.Printf("DeviceCount() error: %v", err)
+		return devices
+	}
+	for i := 0; i < int(numDevices); i++ {
+		d, err := c.device(i)
+		if err != nil {
+			log.Printf("DeviceHandleByIndex(%d) error: %v", i, err)
+			continue
+		}
+		devices[d.uuid] = d.labelValues()
+	}
+	return devices
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeXIDEventSource replays queued events and errors without hardware.
+type fakeXIDEventSource struct {
+	events chan *XIDEvent
+	errs   chan error
+}
+
+func newFakeXIDEventSource() *fakeXIDEventSource {
+	return &fakeXIDEventSource{
+		events: make(chan *XIDEvent, 16),
+		errs:   make(chan error, 16),
+	}
+}
+
+func (s *fakeXIDEventSource) Wait(timeout time.Duration) (*XIDEvent, error) {
+	select {
+	case err := <-s.errs:
+		return nil, err
+	case ev := <-s.events:
+		return ev, nil
+	case <-time.After(10 * time.Millisecond):
+		return nil, nil
+	}
+}
+
+func (s *fakeXIDEventSource) Close() {}
+
+// waitForXIDErrors collects from c until the XID counters add up to want.
+func waitForXIDErrors(t *testing.T, c *Collector, want float64) []prometheus.Metric {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		metrics := collectMetrics(c)
+		var total float64
+		for _, m := range findMetrics(metrics, "nvidia_gpu_xid_errors_total") {
+			total += getCounterValue(m)
+		}
+		if total == want {
+			return metrics
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v XID errors, got %v", want, total)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatchXIDs_CountsPerCode(t *testing.T) {
+	c := makeTestCollector(newTestClient(2), &mockProcessFinder{})
+	c.now = func() time.Time { return time.Unix(1700000000, 0) }
+	src := newFakeXIDEventSource()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.WatchXIDs(src, stop)
+		close(done)
+	}()
+
+	src.events <- &XIDEvent{UUID: "gpu-1", XID: 79}
+	src.events <- &XIDEvent{UUID: "gpu-1", XID: 13}
+	src.events <- &XIDEvent{UUID: "gpu-1", XID: 13}
+
+	metrics := waitForXIDErrors(t, c, 3)
+	close(stop)
+	<-done
+
+	for _, m := range findMetrics(metrics, "nvidia_gpu_xid_errors_total") {
+		labels := getMetricLabels(m)
+		if labels["minor_number"] != "1" || labels["uuid"] != "gpu-1" || labels["name"] != "V100" {
+			t.Errorf("unexpected device labels %v", labels)
+		}
+		want := map[string]float64{"79": 1, "13": 2}[labels["xid"]]
+		if v := getCounterValue(m); v != want {
+			t.Errorf("xid_errors_total{xid=%q} = %v, want %v", labels["xid"], v, want)
+		}
+	}
+
+	last := findMetrics(metrics, "nvidia_gpu_last_xid_error")
+	if len(last) != 1 || getMetricValue(last[0]) != 13 {
+		t.Errorf("expected last_xid_error = 13")
+	}
+	lastTime := findMetrics(metrics, "nvidia_gpu_last_xid_error_timestamp_seconds")
+	if len(lastTime) != 1 || getMetricValue(lastTime[0]) != 1700000000 {
+		t.Errorf("expected last_xid_error_timestamp_seconds = 1700000000")
+	}
+	if at := c.lastXIDAt["gpu-1"]; !at.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("expected the XID time to be recorded for health, got %v", at)
+	}
+}
+
+func TestWatchXIDs_SurvivesErrorsAndUnknownDevices(t *testing.T) {
+	c := makeTestCollector(newTestClient(2), &mockProcessFinder{})
+	src := newFakeXIDEventSource()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	saved := xidWaitTimeout
+	xidWaitTimeout = time.Millisecond
+	defer func() { xidWaitTimeout = saved }()
+	go func() {
+		c.WatchXIDs(src, stop)
+		close(done)
+	}()
+
+	src.errs <- errors.New("nvml: Unknown Error")
+	src.events <- &XIDEvent{UUID: "gpu-gone", XID: 48}
+
+	metrics := waitForXIDErrors(t, c, 1)
+	close(stop)
+	<-done
+
+	xids := findMetrics(metrics, "nvidia_gpu_xid_errors_total")
+	if labels := getMetricLabels(xids[0]); labels["uuid"] != "gpu-gone" || labels["xid"] != "48" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+}
+
+func TestWatchXIDs_OnlyHealthCodesAffectHealth(t *testing.T) {
+	c := makeTestCollector(newTestClient(2), &mockProcessFinder{})
+	c.SetXIDHealthCodes([]uint64{79})
+	src := newFakeXIDEventSource()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.WatchXIDs(src, stop)
+		close(done)
+	}()
+
+	// XID 13 is a graphics engine exception raised by the application.
+	src.events <- &XIDEvent{UUID: "gpu-0", XID: 13}
+	src.events <- &XIDEvent{UUID: "gpu-1", XID: 79}
+
+	waitForXIDErrors(t, c, 2)
+	close(stop)
+	<-done
+
+	c.xidMu.Lock()
+	defer c.xidMu.Unlock()
+	if _, ok := c.lastXIDAt["gpu-0"]; ok {
+		t.Errorf("expected XID 13 not to affect the health of gpu-0")
+	}
+	if _, ok := c.lastXIDAt["gpu-1"]; !ok {
+		t.Errorf("expected XID 79 to affect the health of gpu-1")
+	}
+}
+
+func TestParseXIDCodes(t *testing.T) {
+	codes, err := ParseXIDCodes(" 48,79 ,,92")
+	if err != nil {
+		t.Fatalf("ParseXIDCodes() error: %v", err)
+	}
+	if want := []uint64{48, 79, 92}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("ParseXIDCodes() = %v, want %v", codes, want)
+	}
+	if _, err := ParseXIDCodes("48,x"); err == nil {
+		t.Errorf("ParseXIDCodes() expected an error for an invalid code")
+	}
+}
+
+func TestCollect_NoXIDMetricsWithoutEvents(t *testing.T) {
+	c := makeTestCollector(newTestClient(2), &mockProcessFinder{})
+
+	metrics := collectMetrics(c)
+
+	if xids := findMetrics(metrics, "nvidia_gpu_xid_errors_total"); len(xids) != 0 {
+		t.Errorf("expected no XID metrics, got %d", len(xids))
+	}
+}